@@ -1,10 +1,12 @@
 package main
 
 import(
+    "context"
+    "flag"
     "log"
-    "os"
     "path/filepath"
     "runtime"
+    "time"
     
     //"_leap/luajit"
     "_leap/goluajit"
@@ -13,25 +15,45 @@ import(
 
 var boot string = `
 leap = require('leap')
-threads = {}
 `
 
+var jitmode *string = flag.String("jit", "on", "JIT compiler mode, on or off")
+var timeout *time.Duration = flag.Duration("timeout", 0, "interrupt main.lua after this duration, 0 for no timeout")
+var instructions *int = flag.Int("instructions", 0, "maximum number of lua instructions per call, 0 for no limit")
+var sandbox *string = flag.String("sandbox", "none", "sandbox profile of the app, none, app or strict")
+
+// sandboxes are the sandbox profiles of the -sandbox flag. Apps always get the leap module
+var sandboxes map[string]*luajit.Sandbox = map[string]*luajit.Sandbox{
+    "none": nil,
+    "app": &luajit.Sandbox{
+        Libs: []string{"base", "package", "table", "string", "math", "bit", "os"},
+        Modules: []string{"leap"},
+        Deny: []string{"os.execute", "os.exit", "os.remove", "os.rename", "os.tmpname"},
+    },
+    "strict": &luajit.Sandbox{
+        Libs: []string{"base", "package", "table", "string", "math", "bit"},
+        Modules: []string{"leap"},
+        Deny: []string{"dofile", "loadfile", "getfenv", "setfenv"},
+    },
+}
+
 func main() {
     defer func() {
         if r := recover(); r != nil {
-            log.Println(r.(string))
+            log.Println(r)
         }
     }()
 
     //Check for app directory arg
-    if len(os.Args) == 1 {
+    flag.Parse()
+    if flag.NArg() == 0 {
         log.Fatal("No App Directory Specified")
     } else {
-        log.Println("OS ARG1:",os.Args[1])
+        log.Println("OS ARG1:",flag.Arg(0))
     }
 
     // Attempt to resolve the app directory
-    appdir, abserr := filepath.Abs(os.Args[1]); if abserr != nil {
+    appdir, abserr := filepath.Abs(flag.Arg(0)); if abserr != nil {
         log.Fatal("APP PATH:", abserr)
     } 
     log.Println("APP PATH:",appdir)
@@ -41,31 +63,78 @@ func main() {
     runtime.GOMAXPROCS(runtime.NumCPU())
     
     // Createstate and open libs
-    state := luajit.Newstate()    
+    sandboxprofile, ok := sandboxes[*sandbox]; if !ok {
+        log.Fatal("SANDBOX: unknown profile ", *sandbox)
+    }
+    log.Println("SANDBOX:", *sandbox)
+    state, stateerr := luajit.NewstateWithOptions(luajit.Options{
+        InstructionLimit: *instructions,
+        Sandbox: sandboxprofile,
+    })
+    if stateerr != nil {
+        log.Fatal("NEW STATE:", stateerr)
+    }
     state.Openlibs()
     
+    // Set the JIT compiler mode
+    switch *jitmode {
+    case "on":
+    case "off":
+        if jiterr := state.Setmode(0, luajit.LUAJIT_MODE_ENGINE|luajit.LUAJIT_MODE_OFF); jiterr != nil {
+            log.Fatal("JIT MODE:", jiterr)
+        }
+    default:
+        log.Fatal("JIT MODE: unknown mode ", *jitmode)
+    }
+    log.Println("JIT MODE:", *jitmode)
+    
+    // Report unprotected errors and exit
+    state.Atpanic(func(luapanic *luajit.LuaPanic) {
+        log.Fatal("PANIC:\n", luapanic.Err.Report())
+    })
+    
     // Load modules
     state.Pushmodule("leap", nsleap.NewModule().Loader)
     
     // Load boot.lua
     if bootlerr := state.Loadstring(boot); bootlerr != nil {
-        log.Fatal("Error Loading Boot File", bootlerr)
+        fatal("Error Loading Boot File", bootlerr)
     }
     
     // Call boot.lua
     if bootpcallerr := state.Pcall(0,0,0); bootpcallerr != nil {
-        log.Fatal("Error Calling Boot File", bootpcallerr)
+        fatal("Error Calling Boot File", bootpcallerr)
     }
     
     //Load in a lua chunk
     if loadfileerr := state.Loadfile(appdir+"/main.lua"); loadfileerr != nil {
-        log.Fatal("LOAD MAIN:",loadfileerr)
+        fatal("LOAD MAIN:",loadfileerr)
+    }
+    
+    // Give a sandboxed app its own globals
+    if sandboxprofile != nil {
+        state.Newenv()
+        state.Setfenv(-2)
     }
     
-    //Call the lua chunk
-    pcallerr := state.Pcall(0,0,0); if pcallerr != nil {
-        log.Fatal(pcallerr)        
+    //Call the lua chunk, interrupting it and its threads after the timeout
+    ctx := context.Background()
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
+    }
+    pcallerr := state.PcallContext(ctx,0,0); if pcallerr != nil {
+        fatal("CALL MAIN:", pcallerr)        
     }
     
     log.Println("Exiting")
+}
+
+// fatal logs err, with a full crash report for lua errors, and exits
+func fatal(prefix string, err error) {
+    if luaerr, ok := err.(*luajit.LuaError); ok {
+        log.Fatal(prefix, "\n", luaerr.Report())
+    }
+    log.Fatal(prefix, err)
 }
\ No newline at end of file
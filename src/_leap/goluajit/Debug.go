@@ -0,0 +1,94 @@
+package luajit
+
+/*
+#include <lua.h>
+*/
+import "C"
+
+// A Debug is used to carry different pieces of information about an active
+// function. Getstack fills only the private part of this structure, for
+// later use. To fill the other fields of Debug with useful information,
+// call Getinfo.
+type Debug struct {
+    // The event that triggered the current hook function.
+    Event int
+    // A reasonable name for the given function. Because functions in
+    // Lua are first-class values, they do not have a fixed name: some
+    // functions can be the value of multiple global variables, while
+    // others can be stored only in a table field. Getinfo checks how
+    // the function was called to find a suitable name. If it cannot find
+    // a name, then Name is an empty string.
+    Name string
+    // Explains the Name field. The value of Namewhat can be "global",
+    // "local", "method", "field", "upvalue", or "" (the empty string),
+    // according to how the function was called.
+    Namewhat string
+    // The string "Lua" if the function is a Lua function, "Go" if it
+    // is a Go or C function, "main" if it is the main part of a chunk, and
+    // "tail" if it was a function that did a tail call. In the latter
+    // case, Lua has no other information about the function.
+    What string
+    // If the function was defined in a string, then Source is that
+    // string. If the function was defined in a file, then Source starts
+    // with a '@' followed by the file name.
+    Source string
+    // "Printable" version of Source, for use in error messages.
+    Shortsrc string
+    // The current line where the given function is executing. When no
+    // line information is available, Currentline is set to -1.
+    Currentline int
+    // The number of upvalues of the function.
+    Nups int
+    // The line number where the definition of the function starts.
+    Linedefined int
+    // The line number where the definition of the function ends.
+    Lastlinedefined int
+
+    // ar is the lua_Debug filled by lua. It holds no go pointers, so it may
+    // be passed to C as is.
+    ar C.lua_Debug
+}
+
+// Type for debug hook functions.
+//
+// Whenever a hook is called, its ar argument has its Event field set to
+// the specific event that triggered the hook: LUA_HOOKCALL, LUA_HOOKRET,
+// LUA_HOOKTAILRET, LUA_HOOKLINE or LUA_HOOKCOUNT. Moreover, for line
+// events, the Currentline field is also set. To get the value of any other
+// field in ar, the hook must call Getinfo. For return events, Event can be
+// LUA_HOOKRET, the normal value, or LUA_HOOKTAILRET. In the latter case,
+// Lua is simulating a return from a function that did a tail call; in this
+// case, it is useless to call Getinfo.
+//
+// While Lua is running a hook, it disables other calls to hooks. Therefore,
+// if a hook calls back Lua to execute a function or a chunk, this execution
+// occurs without any calls to hooks.
+//
+// A hook may raise a lua error in the running function with Error, like a
+// Gofunction. A go panic in a hook is raised the same way.
+type Hook func(s *State, ar *Debug)
+
+// update syncs the exported fields of a Debug with its lua_Debug
+func (this *Debug) update() {
+    this.Event = int(this.ar.event)
+    this.Name = gostring(this.ar.name)
+    this.Namewhat = gostring(this.ar.namewhat)
+    this.What = gostring(this.ar.what)
+    if this.What == "C" {
+        this.What = "Go"
+    }
+    this.Source = gostring(this.ar.source)
+    this.Shortsrc = C.GoString(&this.ar.short_src[0])
+    this.Currentline = int(this.ar.currentline)
+    this.Nups = int(this.ar.nups)
+    this.Linedefined = int(this.ar.linedefined)
+    this.Lastlinedefined = int(this.ar.lastlinedefined)
+}
+
+// gostring is C.GoString returning "" for NULL fields lua left unset
+func gostring(cs *C.char) string {
+    if cs == nil {
+        return ""
+    }
+    return C.GoString(cs)
+}
\ No newline at end of file
@@ -0,0 +1,174 @@
+package luajit
+
+import(
+    "context"
+    "errors"
+)
+
+/*
+#include <lua.h>
+#include <stdint.h>
+
+extern uintptr_t goluajit_gethook(lua_State*);
+extern int goluajit_jitstatus(lua_State*);
+*/
+import "C"
+
+// interruptcount is the number of instructions between two checks of the watched
+// calls, when the count hook set with Sethook does not check more often
+const interruptcount = 1000
+
+// ErrInstructionLimit is the Cause of the *LuaError returned by a call that ran past
+// the InstructionLimit of its state.
+var ErrInstructionLimit error = errors.New("STATE: instruction limit exceeded")
+
+// An execution is a call watched by the count hook: a PcallContext, or a Pcall on a
+// state with an InstructionLimit. Calls made by a Gofunction run within the execution
+// of the call that called it, its parent.
+type execution struct {
+    ctx context.Context
+    
+    // budget is the number of instructions the call may still run, when limited
+    budget int
+    limited bool
+    
+    // err is the reason the call was interrupted, nil while it may run
+    err error
+    parent *execution
+}
+
+// PcallContext calls a function in protected mode like Pcall with an errfunc of 0,
+// and interrupts the call once ctx is done.
+//
+// The running lua code is interrupted by a lua error raised from the count hook,
+// which is checked every 1000 instructions, or as often as the count hook set with
+// Sethook. The returned *LuaError has the error of ctx as its Cause, so callers may
+// test it with errors.Is(err, context.Canceled) or context.DeadlineExceeded. A lua
+// pcall may catch the error, but it is raised again by the next check until the call
+// returns. Gofunctions that block must watch ctx themselves, see Context.
+//
+// Luajit does not call hooks from compiled code, so compiled code is flushed and the
+// JIT compiler is turned off while watched calls of the global state run, then turned
+// back on. Lua code turning the compiler on itself escapes the checks. The 
+// InstructionLimit of the state applies to PcallContext too.
+func (this *State) PcallContext(ctx context.Context, nargs, nresults int) error {
+    if this.Dead() {
+        return ErrDeadState
+    }
+    
+    return this.watch(ctx, func() error {
+        return this.pcall(nargs, nresults, 0)
+    })
+}
+
+// Context returns the context of the innermost PcallContext running on the goroutine
+// holding the Gil, or context.Background() outside of any. Gofunctions use it to stop
+// blocking operations, or to run work they start, such as another thread, under the
+// context of their caller.
+func (this *State) Context() context.Context {
+    for e := this.root().execution; e != nil; e = e.parent {
+        if e.ctx != nil {
+            return e.ctx
+        }
+    }
+    return context.Background()
+}
+
+// watch runs call as an execution watched for ctx and the InstructionLimit of the
+// state. Without either, call runs within the current execution, if any. A context
+// that is never done, such as context.Background(), is not watched.
+func (this *State) watch(ctx context.Context, call func() error) error {
+    root := this.root()
+    if ctx != nil && ctx.Done() == nil {
+        ctx = nil
+    }
+    if ctx == nil && root.instructionlimit == 0 {
+        return interruption(call(), root.execution)
+    }
+    
+    exec := &execution{
+        ctx: ctx,
+        budget: root.instructionlimit,
+        limited: root.instructionlimit > 0,
+        parent: root.execution,
+    }
+    root.execution = exec
+    root.watching++
+    if root.watching == 1 {
+        // compiled code runs without calling hooks, so the compiler is off while 
+        // watched calls run
+        root.jitwatched = C.goluajit_jitstatus(this.luastate) != 0
+        if root.jitwatched {
+            this.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_FLUSH)
+            this.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_OFF)
+        }
+        this.sethook(int(C.goluajit_gethook(this.luastate)))
+    }
+    
+    defer func() {
+        root.execution = exec.parent
+        root.watching--
+        if exec.err != nil {
+            root.interrupting--
+        }
+        if root.watching == 0 || exec.err != nil && root.interrupting == 0 {
+            this.sethook(int(C.goluajit_gethook(this.luastate)))
+            if root.jitwatched {
+                this.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_ON)
+            }
+        }
+    }()
+    
+    return interruption(call(), exec)
+}
+
+// interruption sets the Cause of err when exec or one of its parents was interrupted
+func interruption(err error, exec *execution) error {
+    luaerr, ok := err.(*LuaError); if !ok || luaerr.Code != LUA_ERRRUN {
+        return err
+    }
+    
+    for e := exec; e != nil; e = e.parent {
+        if e.err != nil {
+            luaerr.Cause = e.err
+            break
+        }
+    }
+    return err
+}
+
+// interrupted is called by the count hook of the root State after count instructions.
+// It charges them to the executions of the goroutine holding the Gil and returns the
+// reason the innermost interrupted one must stop, or nil.
+//
+// Once an execution is interrupted, the hook is called on every instruction until it
+// returns, so a lua pcall catching the error cannot run on.
+func (this *State) interrupted(count int) error {
+    var err error
+    interrupting := this.interrupting
+    for e := this.execution; e != nil; e = e.parent {
+        if e.err == nil && e.limited {
+            e.budget -= count
+            if e.budget < 0 {
+                e.err = ErrInstructionLimit
+                this.interrupting++
+            }
+        }
+        if e.err == nil && e.ctx != nil {
+            select {
+                case <- e.ctx.Done():
+                    e.err = e.ctx.Err()
+                    this.interrupting++
+                default:
+            }
+        }
+        if err == nil {
+            err = e.err
+        }
+    }
+    
+    if interrupting == 0 && this.interrupting > 0 {
+        this.sethook(int(C.goluajit_gethook(this.luastate)))
+    }
+    return err
+}
\ No newline at end of file
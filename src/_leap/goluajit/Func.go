@@ -0,0 +1,263 @@
+package luajit
+
+import(
+    "errors"
+    "reflect"
+    "strconv"
+    "strings"
+    "unsafe"
+)
+
+// statetype and errortype are the reflect.Types of *State and error
+var statetype reflect.Type = reflect.TypeOf((*State)(nil))
+var errortype reflect.Type = reflect.TypeOf((*error)(nil)).Elem()
+
+// FuncOptions configures the lua functions made by NewFunc
+type FuncOptions struct {
+    // RaiseErrors raises a non-nil trailing error result as a lua error, instead of
+    // returning nil and the error message
+    RaiseErrors bool
+}
+
+// funcadapter calls a go function of any signature from lua
+type funcadapter struct {
+    fn reflect.Value
+    options FuncOptions
+    
+    // receiver is the class of the receiver of a method, taken from the first lua
+    // argument, nil for other functions
+    receiver *class
+    
+    // withstate is set when the first parameter is the calling *State, params are the
+    // parameters converted from lua arguments and returnserror is set when the last
+    // result is an error
+    withstate bool
+    params []reflect.Type
+    returnserror bool
+}
+
+// NewFunc returns a Gofunction calling fn, a go function of any signature, with the
+// arguments of the lua call converted as by ToValue and its results pushed as by Push.
+//
+// If the first parameter of fn is a *State, it receives the calling State and the
+// lua arguments are passed to the following parameters. Extra lua arguments are
+// ignored, and a variadic fn receives them all. Parameters of pointer, interface,
+// map and slice types receive nil for nil or missing arguments, so such trailing
+// parameters are optional. An argument that cannot be converted raises a lua error
+// like:
+//
+// 	bad argument #2 to 'x' (number expected, got string)
+//
+// If the last result of fn is an error, it is not pushed. A non-nil error makes the
+// function return nil and the error message, the lua convention, or raise the error
+// with FuncOptions.RaiseErrors. A function with no other result returns true when
+// the error is nil.
+func NewFunc(fn interface{}, options FuncOptions) (Gofunction, error) {
+    v := reflect.ValueOf(fn)
+    if v.Kind() != reflect.Func || v.IsNil() {
+        return nil, errors.New("FUNC: expected a non-nil function, got " + reflect.TypeOf(fn).String())
+    }
+    return newfuncadapter(v, options, nil).call, nil
+}
+
+// newfuncadapter returns the adapter of the function fn, or of the method fn of the
+// receiver class, whose first parameter is the receiver
+func newfuncadapter(fn reflect.Value, options FuncOptions, receiver *class) *funcadapter {
+    t := fn.Type()
+    adapter := &funcadapter{
+        fn: fn,
+        options: options,
+        receiver: receiver,
+        params: []reflect.Type{},
+    }
+    
+    first := 0
+    if receiver != nil {
+        first = 1
+    }
+    for i := first; i < t.NumIn(); i++ {
+        if i == first && t.In(i) == statetype {
+            adapter.withstate = true
+            continue
+        }
+        adapter.params = append(adapter.params, t.In(i))
+    }
+    adapter.returnserror = t.NumOut() > 0 && t.Out(t.NumOut() - 1) == errortype
+    
+    return adapter
+}
+
+// RegisterFunc sets the global name to a lua function calling fn, as made by NewFunc
+// with no options.
+func (this *State) RegisterFunc(name string, fn interface{}) error {
+    return this.RegisterFuncWithOptions(name, fn, FuncOptions{})
+}
+
+// RegisterFuncWithOptions sets the global name to a lua function calling fn, as made
+// by NewFunc with options.
+func (this *State) RegisterFuncWithOptions(name string, fn interface{}, options FuncOptions) error {
+    gofunction, err := NewFunc(fn, options); if err != nil {
+        return err
+    }
+    this.Register(gofunction, name)
+    return nil
+}
+
+// call is the Gofunction of the adapter
+func (this *funcadapter) call(ls *State) int {
+    nargs := ls.Gettop()
+    in := make([]reflect.Value, 0, len(this.params) + 2)
+    
+    // first is the lua argument of the first parameter, after the receiver
+    first := 1
+    if this.receiver != nil {
+        // a call with . instead of : passes no receiver
+        if ls.toobject(1) == nil {
+            got := ls.Typename(1)
+            if ls.Isnone(1) {
+                got = "no value"
+            }
+            ls.Argerror(1, this.receiver.name + " expected, got " + got + ", call methods with ':'")
+        }
+        in = append(in, this.receiver.check(ls, 1))
+        first = 2
+    }
+    if this.withstate {
+        in = append(in, reflect.ValueOf(ls))
+    }
+    
+    fixed := len(this.params)
+    if this.fn.Type().IsVariadic() {
+        fixed--
+    }
+    for i := 0; i < fixed; i++ {
+        in = append(in, this.arg(ls, first + i, this.params[i]))
+    }
+    if fixed < len(this.params) {
+        elem := this.params[fixed].Elem()
+        for narg := first + fixed; narg <= nargs; narg++ {
+            in = append(in, this.arg(ls, narg, elem))
+        }
+    }
+    
+    out := this.fn.Call(in)
+    
+    if this.returnserror {
+        errvalue := out[len(out) - 1]
+        out = out[:len(out) - 1]
+        if !errvalue.IsNil() {
+            message := errvalue.Interface().(error).Error()
+            if this.options.RaiseErrors {
+                ls.Pushstring(message)
+                ls.Error()
+            }
+            ls.Pushnil()
+            ls.Pushstring(message)
+            return 2
+        }
+        if len(out) == 0 {
+            ls.Pushboolean(true)
+            return 1
+        }
+    }
+    
+    for i, result := range out {
+        if err := ls.pushreflect(result, make(map[pushref]bool), ""); err != nil {
+            ls.Pushstring("bad result #" + strconv.Itoa(i + 1) + " (" + strings.TrimPrefix(err.Error(), "PUSH: ") + ")")
+            ls.Error()
+        }
+    }
+    return len(out)
+}
+
+// arg converts the argument narg to a value of type t, raising argument errors
+func (this *funcadapter) arg(ls *State, narg int, t reflect.Type) reflect.Value {
+    v := reflect.New(t).Elem()
+    
+    if obj := ls.toobject(narg); obj != nil && obj.value.Type().AssignableTo(t) {
+        v.Set(obj.value)
+        return v
+    }
+    if expected := luatypename(t); expected != "" && !accepts(t, ls.Type(narg)) {
+        ls.Typeerror(narg, expected)
+    }
+    if err := ls.toreflect(narg, v, make(map[unsafe.Pointer]bool), ""); err != nil {
+        ls.Argerror(narg, strings.TrimPrefix(err.Error(), "TOVALUE: "))
+    }
+    return v
+}
+
+// luatypename returns the name of the lua type converted to values of type t, or ""
+// for empty interfaces and Value which take any value
+func luatypename(t reflect.Type) string {
+    if name, ok := valuetypenames[t]; ok {
+        return name
+    }
+    switch t.Kind() {
+        case reflect.Bool:
+            return "boolean"
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+            reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+            reflect.Float32, reflect.Float64:
+            return "number"
+        case reflect.String:
+            return "string"
+        case reflect.Slice:
+            if t.Elem().Kind() == reflect.Uint8 {
+                return "string"
+            }
+            return "table"
+        case reflect.Array, reflect.Map, reflect.Struct:
+            return "table"
+        case reflect.Ptr:
+            return luatypename(t.Elem())
+        case reflect.Interface:
+            if t.NumMethod() == 0 {
+                return ""
+            }
+    }
+    return t.String()
+}
+
+// accepts returns whether a lua value of type luatype converts to type t
+func accepts(t reflect.Type, luatype int) bool {
+    switch t.Kind() {
+        case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+            if luatype == LUA_TNIL || luatype == LUA_TNONE {
+                return true
+            }
+    }
+    if name, ok := valuetypenames[t]; ok {
+        switch name {
+            case "":
+                return true
+            case "nil":
+                return luatype == LUA_TNIL || luatype == LUA_TNONE
+            case "table":
+                return luatype == LUA_TTABLE
+            case "function":
+                return luatype == LUA_TFUNCTION
+            case "userdata":
+                return luatype == LUA_TUSERDATA || luatype == LUA_TLIGHTUSERDATA
+            case "thread":
+                return luatype == LUA_TTHREAD
+        }
+    }
+    if t.Kind() == reflect.Ptr {
+        return accepts(t.Elem(), luatype)
+    }
+    
+    switch luatypename(t) {
+        case "boolean":
+            return luatype == LUA_TBOOLEAN
+        case "number":
+            return luatype == LUA_TNUMBER
+        case "string":
+            return luatype == LUA_TSTRING || t.Kind() == reflect.Slice && luatype == LUA_TTABLE
+        case "table":
+            return luatype == LUA_TTABLE
+        case "":
+            return true
+    }
+    return false
+}
\ No newline at end of file
@@ -0,0 +1,32 @@
+package luajit
+
+import(
+    "sync"
+)
+
+// Gil is the global interpreter lock of a lua global state. A root State created by
+// Newstate and every thread created from it with Newthread share a single Gil, as they
+// share a single C global state that LuaJIT does not protect against concurrent access.
+//
+// Only the goroutine holding the Gil may enter the C API. Go functions called from lua 
+// already run under the Gil, and must release it with State.Unlocked while they block so
+// that other goroutines may run lua code in the meantime.
+type Gil struct {
+    mutex *sync.Mutex
+}
+
+func NewGil() *Gil {
+    return &Gil{
+        mutex: &sync.Mutex{},
+    }
+}
+
+// Lock acquires the Gil, blocking until it is available.
+func (this *Gil) Lock() {
+    this.mutex.Lock()
+}
+
+// Unlock releases the Gil. It is a run-time error if the Gil is not locked.
+func (this *Gil) Unlock() {
+    this.mutex.Unlock()
+}
@@ -1,5 +1,9 @@
 package luajit
 
+import(
+    "runtime/debug"
+)
+
 // A Gofunction is a Go function that may be registered with the Lua
 // interpreter and called by Lua programs.
 //
@@ -32,4 +36,21 @@ package luajit
 // 		s.Pushnumber(sum)	// second result
 // 		return 2		// number of results
 // 	}
-type Gofunction func(*State) int
\ No newline at end of file
+type Gofunction func(*State) int
+
+// A Goerrorfunction is a Gofunction that reports failure by returning a non nil
+// error instead of calling State.Error. Use Errorfunction to register it.
+type Goerrorfunction func(*State) (int, error)
+
+// Errorfunction adapts fn to a Gofunction that raises a lua error with the message 
+// of the error returned by fn, if any, followed by the go stack like a go panic.
+func Errorfunction(fn Goerrorfunction) Gofunction {
+    return func(s *State) int {
+        n, err := fn(s)
+        if err != nil {
+            s.Pushstring(err.Error() + "\n" + string(debug.Stack()))
+            s.Error()
+        }
+        return n
+    }
+}
\ No newline at end of file
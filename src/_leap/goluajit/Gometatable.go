@@ -1,10 +1,51 @@
 package luajit
 
+// A Gometatable describes a metatable whose metamethods are Gofunctions, see 
+// Pushmetatable. Each metamethod receives its operands as in lua: __index gets the 
+// object and the key, __add the two operands, __call the object followed by the 
+// arguments of the call, and so on.
 type Gometatable struct {
     IndexFunction    Gofunction
     NewindexFunction Gofunction
     TostringFunction Gofunction    
     GCFunction       Gofunction
+    
+    // __call, __len, __concat and __unm
+    CallFunction     Gofunction
+    LenFunction      Gofunction
+    ConcatFunction   Gofunction
+    UnmFunction      Gofunction
+    
+    // __eq, __lt and __le. Lua only calls them for two operands sharing the same 
+    // metamethod, so they need a Name.
+    EqFunction       Gofunction
+    LtFunction       Gofunction
+    LeFunction       Gofunction
+    
+    // __add, __sub, __mul, __div, __mod and __pow
+    AddFunction      Gofunction
+    SubFunction      Gofunction
+    MulFunction      Gofunction
+    DivFunction      Gofunction
+    ModFunction      Gofunction
+    PowFunction      Gofunction
+    
+    // Methods are called with the : syntax on the objects of a named metatable. They 
+    // are kept in a table under __methods, which is also the __index of the metatable
+    // unless IndexFunction is set.
+    Methods          map[string]Gofunction
+    
+    // Mode is the __mode of weak tables: "k", "v" or "kv"
+    Mode             string
+    
+    // Metatable protects the metatable: getmetatable returns it instead of the 
+    // metatable, and setmetatable fails. Empty leaves the metatable unprotected.
+    Metatable        string
+    
+    // Name caches the metatable in the registry under Name, as luaL_newmetatable 
+    // does. The first Pushmetatable with a Name builds the metatable, and later ones
+    // push it again, whatever their Gometatable holds. See Pushmetatable.
+    Name             string
 }
 
 func (this *Gometatable) Index() Gofunction {
@@ -21,4 +62,32 @@ func (this *Gometatable) Tostring() Gofunction {
 
 func (this *Gometatable) GC() Gofunction {
     return this.GCFunction
+}
+
+// A metamethod is a metatable key and its Gofunction
+type metamethod struct {
+    key string
+    fn Gofunction
+}
+
+// metamethods returns the metamethods of the Gometatable, except __gc
+func (this *Gometatable) metamethods() []metamethod {
+    return []metamethod{
+        {"__index", this.Index()},
+        {"__newindex", this.Newindex()},
+        {"__tostring", this.Tostring()},
+        {"__call", this.CallFunction},
+        {"__len", this.LenFunction},
+        {"__concat", this.ConcatFunction},
+        {"__unm", this.UnmFunction},
+        {"__eq", this.EqFunction},
+        {"__lt", this.LtFunction},
+        {"__le", this.LeFunction},
+        {"__add", this.AddFunction},
+        {"__sub", this.SubFunction},
+        {"__mul", this.MulFunction},
+        {"__div", this.DivFunction},
+        {"__mod", this.ModFunction},
+        {"__pow", this.PowFunction},
+    }
 }
\ No newline at end of file
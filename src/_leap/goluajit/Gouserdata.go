@@ -0,0 +1,100 @@
+package luajit
+
+/*
+#include <lua.h>
+#include <stdint.h>
+
+extern void goluajit_pushobjectgc(lua_State*);
+extern void goluajit_newobject(lua_State*, uintptr_t);
+extern uintptr_t goluajit_toobject(lua_State*, int);
+*/
+import "C"
+
+// A gouserdata is the go value of a userdata pushed by NewGouserdata, with the type it
+// was pushed as
+type gouserdata struct {
+    value interface{}
+    typename string
+}
+
+// NewGouserdata pushes onto the stack a new full userdata holding the go value v, 
+// with the metatable registered under typename, see Newmetatable and the Name of a 
+// Gometatable. The metatable is created empty if needed, so set up named metatables 
+// with Pushmetatable before their first userdata.
+//
+// The userdata block holds the GovalueRegistry index of v, never a go pointer, and the
+// type is kept with v on the go side. Lua code cannot change either, and giving another
+// userdata the metatable of the type, as debug.setmetatable can, does not make it a
+// userdata of the type, so Gofunctions may trust the value CheckGouserdata returns. The
+// value is released once lua collects the userdata, after the GC function of its 
+// Gometatable, if any, was called.
+func (this *State) NewGouserdata(v interface{}, typename string) {
+    if !this.Checkstack(3) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    C.goluajit_newobject(this.luastate, C.uintptr_t(this.Registry().AddValue(&gouserdata{value: v, typename: typename})))
+    this.Newmetatable(typename)
+    
+    // a metatable without a __gc releases the value itself
+    this.Getfield(-1, "__gc")
+    if this.Isnil(-1) {
+        C.goluajit_pushobjectgc(this.luastate)
+        this.Setfield(-3, "__gc")
+    }
+    this.Pop(1)
+    this.Setmetatable(-2)
+}
+
+// CheckGouserdata returns the go value of the userdata pushed by NewGouserdata at 
+// narg, raising an argument error if it is not a userdata of the type typename:
+//
+// 	bad argument #1 to 'send' (leap.Channel expected, got table)
+func (this *State) CheckGouserdata(narg int, typename string) interface{} {
+    v, ok := this.Togouserdata(narg, typename); if !ok {
+        this.Typeerror(narg, typename)
+    }
+    return v
+}
+
+// Togouserdata returns the go value of the userdata pushed by NewGouserdata at the 
+// given index, and false if it is not a userdata pushed with the type typename.
+func (this *State) Togouserdata(index int, typename string) (interface{}, bool) {
+    ud, ok := this.togouserdata(index); if !ok || ud.typename != typename {
+        return nil, false
+    }
+    return ud.value, true
+}
+
+// togouserdata returns the gouserdata of the userdata at index, and false if it was not
+// pushed by NewGouserdata
+func (this *State) togouserdata(index int) (*gouserdata, bool) {
+    handle := int(C.goluajit_toobject(this.luastate, C.int(index)))
+    if handle == 0 {
+        return nil, false
+    }
+    
+    v, err := this.Registry().GetValue(handle); if err != nil {
+        return nil, false
+    }
+    ud, ok := v.(*gouserdata)
+    return ud, ok
+}
+
+// releasegouserdata releases the go value of the userdata at index, if it was pushed 
+// by NewGouserdata
+func (this *State) releasegouserdata(index int) {
+    if handle := int(C.goluajit_toobject(this.luastate, C.int(index))); handle != 0 {
+        this.Registry().RemoveValue(handle)
+    }
+}
+
+//export doobjectgc
+func doobjectgc(stateindex C.uintptr_t, objectindex C.uintptr_t) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        return
+    }
+    
+    // release the go value of a collected userdata
+    stateval.(*State).gvregistry.RemoveValue(int(objectindex))
+}
\ No newline at end of file
@@ -2,20 +2,40 @@ package luajit
 
 import(
     "sync"
+    "sync/atomic"
     "errors"
 )
 
+// GovalueRegistry holds golang values in which their registry indexes are to be passed 
+// to the C runtime. upon return from the C runtime, we can use the Registry Indexes 
+// sent back from C to obtain our real values. NEVER EVER SEND GOLANG POINTERS TO C. 
+// golang may change pointer values during scheduling and GC, so references to go 
+// pointers in C may age-out 
+//
+// Every root State owns a GovalueRegistry, shared with its threads and dropped by 
+// State.Close (see State.Registry). Indexes are unique across all registries, so 
+// looking up the index of a value held by another state fails.
 type GovalueRegistry struct {
     mutex *sync.Mutex    
     registry map[int]interface{}
-    currindex int
+    added int
+    removed int
+}
+
+// GovalueRegistryStats is a snapshot of the GovalueRegistry counters
+type GovalueRegistryStats struct {
+    // Len is the number of values currently held
+    Len int
+    
+    // Added and Removed count the values ever added and removed
+    Added int
+    Removed int
 }
 
 func NewGovalueRegistry() *GovalueRegistry {
     return &GovalueRegistry{
         mutex: &sync.Mutex{}, 
         registry: make(map[int]interface{}),
-        currindex: 0,
     }
 }
 
@@ -23,10 +43,11 @@ func (this *GovalueRegistry) AddValue(govalue interface{}) int {
     this.mutex.Lock()
     defer this.mutex.Unlock()
     
-    this.currindex++    
-    this.registry[this.currindex] = govalue
+    index := int(atomic.AddInt64(&lastindex, 1))
+    this.registry[index] = govalue
+    this.added++
     
-    return this.currindex
+    return index
 }
 
 func (this *GovalueRegistry) GetValue(INDEX int) (interface{}, error) {
@@ -35,7 +56,7 @@ func (this *GovalueRegistry) GetValue(INDEX int) (interface{}, error) {
     
     val, ok := this.registry[INDEX]
     if !ok {
-        return nil, errors.New("Invalid Index Supplied. Index does not exist")
+        return nil, errors.New("Invalid Index Supplied. Index does not exist in this state")
     } else {
         return val, nil
     }    
@@ -47,9 +68,39 @@ func (this *GovalueRegistry) RemoveValue(INDEX int) error {
 
     _, ok := this.registry[INDEX]
     if !ok {
-        return errors.New("Invalid Index Supplied. Index does not exist")
+        return errors.New("Invalid Index Supplied. Index does not exist in this state")
     } else {
         delete(this.registry, INDEX);
+        this.removed++
         return nil
     }
+}
+
+// Len returns the number of values currently held by the registry
+func (this *GovalueRegistry) Len() int {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    return len(this.registry)
+}
+
+// Stats returns the current registry counters
+func (this *GovalueRegistry) Stats() GovalueRegistryStats {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    return GovalueRegistryStats{
+        Len: len(this.registry),
+        Added: this.added,
+        Removed: this.removed,
+    }
+}
+
+// clear removes every value from the registry
+func (this *GovalueRegistry) clear() {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    this.removed += len(this.registry)
+    this.registry = make(map[int]interface{})
 }
\ No newline at end of file
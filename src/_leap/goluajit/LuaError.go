@@ -0,0 +1,118 @@
+package luajit
+
+import(
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// LuaError is the error returned by Pcall, Resume, Loadstring and Loadfile when lua 
+// reports an error.
+type LuaError struct {
+    // Code is one of LUA_ERRRUN, LUA_ERRSYNTAX, LUA_ERRMEM or LUA_ERRERR
+    Code int
+    
+    // Message is the error value converted to a string, or a description of it when 
+    // it is not a string or a number
+    Message string
+    
+    // Value is the original error value converted to a go value: nil, bool, float64, 
+    // string or map[interface{}]interface{} for tables. Other lua types are nil.
+    Value interface{}
+    
+    // Source and Line locate where the error was raised, when known
+    Source string
+    Line int
+    
+    // Traceback is the lua stack traceback at the point of the error. It is only 
+    // available for runtime errors raised under Pcall, without a caller supplied 
+    // errfunc, and under Resume.
+    Traceback string
+    
+    // Cause is the reason execution was interrupted, for errors raised because the
+    // context of PcallContext is done or the InstructionLimit of the state ran out. It 
+    // is nil for other errors.
+    Cause error
+}
+
+// Error returns the error message prefixed with a description of the error code.
+func (this *LuaError) Error() string {
+    errstr := ""
+    
+    switch this.Code {
+        case LUA_ERRERR:
+            errstr = LUA_ERRERR_STR
+            break
+        case LUA_ERRSYNTAX:
+            errstr = LUA_ERRSYNTAX_STR
+            break
+        case LUA_ERRRUN:
+            errstr = LUA_ERRRUN_STR
+            break
+        case LUA_ERRMEM:
+            errstr = LUA_ERRMEM_STR
+            break
+        default:
+            errstr = LUA_ERRUNK_STR
+    }
+    
+    return errstr + this.Message
+}
+
+// Unwrap returns the Cause of the error, so errors.Is can tell interrupted calls apart:
+//
+// 	if errors.Is(err, context.DeadlineExceeded) {
+// 		...
+// 	}
+func (this *LuaError) Unwrap() error {
+    return this.Cause
+}
+
+// Report returns a multi line description of the error including its location and 
+// traceback, suitable for crash reports.
+func (this *LuaError) Report() string {
+    lines := []string{this.Error()}
+    
+    if this.Source != "" {
+        lines = append(lines, "at " + this.Source + ":" + strconv.Itoa(this.Line))
+    }
+    if this.Traceback != "" {
+        lines = append(lines, this.Traceback)
+    }
+    
+    return strings.Join(lines, "\n")
+}
+
+// errorlocation matches the "chunkname:line:" prefix lua adds to error messages
+var errorlocation *regexp.Regexp = regexp.MustCompile(`^(.+?):(\d+): `)
+
+// locate sets Source and Line from the message prefix if they are not known yet
+func (this *LuaError) locate() {
+    if this.Source != "" {
+        return
+    }
+    
+    match := errorlocation.FindStringSubmatch(this.Message)
+    if match == nil {
+        return
+    }
+    
+    this.Source = match[1]
+    this.Line, _ = strconv.Atoi(match[2])
+}
+
+// LuaPanic describes an error raised outside any protected environment. It is 
+// passed to the Panichandler of the state and is the value of the go panic that 
+// follows (see State.Atpanic).
+type LuaPanic struct {
+    // State is the thread the error happened in
+    State *State
+    Err *LuaError
+}
+
+func (this *LuaPanic) Error() string {
+    return "PANIC: unprotected error in lua state: " + this.Err.Error()
+}
+
+// A Panichandler is called with unprotected errors of a state, see State.Atpanic.
+type Panichandler func(*LuaPanic)
@@ -0,0 +1,583 @@
+package luajit
+
+import(
+    "errors"
+    "fmt"
+    "math"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "unsafe"
+)
+
+// gofunctiontype is the reflect.Type of Gofunction
+var gofunctiontype reflect.Type = reflect.TypeOf(Gofunction(nil))
+
+// structfields caches the luafields of struct types
+var structfields sync.Map
+
+// A luafield is a field of a struct marshaled to and from a field of a lua table
+type luafield struct {
+    name string
+    index []int
+}
+
+// pushref identifies a go value being pushed, to detect cycles
+type pushref struct {
+    ptr uintptr
+    typ reflect.Type
+}
+
+// Push pushes the go value v onto the stack as a lua value:
+//
+// 	nil, nil pointers, maps, slices and functions    nil
+// 	bool                                              boolean
+// 	ints, uints and floats                            number
+// 	string and []byte                                 string
+// 	slices and arrays                                 table, a sequence from index 1
+// 	maps                                              table
+// 	structs                                           table of the exported fields
+// 	Gofunction and func(*State) int                   function
+// 	other functions                                   function, see NewFunc
+// 	pointers of types registered with RegisterType    userdata, see PushObject
+// 	Value                                             the lua value it holds
+//
+// Pointers and interfaces push the value they point to. A struct field is stored
+// under the name in its `lua:"name"` tag, or its go name, and skipped with a tag of
+// `lua:"-"`. The fields of embedded structs are stored as fields of the table.
+//
+// Push returns an error, and pushes nothing, for values it cannot push, such as
+// channels, and for cyclic values.
+func (this *State) Push(v interface{}) error {
+    top := this.Gettop()
+    if err := this.pushreflect(reflect.ValueOf(v), make(map[pushref]bool), ""); err != nil {
+        this.Settop(top)
+        return err
+    }
+    return nil
+}
+
+// pushreflect pushes v, path locates v within the value given to Push for errors
+func (this *State) pushreflect(v reflect.Value, seen map[pushref]bool, path string) error {
+    if !this.Checkstack(3) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    if !v.IsValid() {
+        this.Pushnil()
+        return nil
+    }
+    
+    if v.Kind() != reflect.Interface && v.Type().Implements(valuetype) && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+        if err := v.Interface().(Value).push(this); err != nil {
+            return errors.New(err.Error() + at(path))
+        }
+        return nil
+    }
+    if v.Kind() == reflect.Ptr && !v.IsNil() {
+        if class, ok := this.root().classes[v.Type()]; ok {
+            class.push(this, v)
+            return nil
+        }
+    }
+    if v.Kind() == reflect.Func {
+        if v.IsNil() {
+            this.Pushnil()
+        } else if v.Type().ConvertibleTo(gofunctiontype) {
+            this.Pushfunction(v.Convert(gofunctiontype).Interface().(Gofunction))
+        } else {
+            gofunction, err := NewFunc(v.Interface(), FuncOptions{}); if err != nil {
+                return err
+            }
+            this.Pushfunction(gofunction)
+        }
+        return nil
+    }
+    
+    switch v.Kind() {
+        case reflect.Bool:
+            this.Pushboolean(v.Bool())
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            this.Pushnumber(float64(v.Int()))
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            this.Pushnumber(float64(v.Uint()))
+        case reflect.Float32, reflect.Float64:
+            this.Pushnumber(v.Float())
+        case reflect.String:
+            this.Pushlstring([]byte(v.String()))
+        case reflect.Slice:
+            if v.IsNil() {
+                this.Pushnil()
+                return nil
+            }
+            if v.Type().Elem().Kind() == reflect.Uint8 {
+                this.Pushlstring(v.Bytes())
+                return nil
+            }
+            ref := pushref{v.Pointer(), v.Type()}
+            if seen[ref] {
+                return errors.New("PUSH: cyclic value" + at(path))
+            }
+            seen[ref] = true
+            defer delete(seen, ref)
+            return this.pushsequence(v, seen, path)
+        case reflect.Array:
+            return this.pushsequence(v, seen, path)
+        case reflect.Map:
+            if v.IsNil() {
+                this.Pushnil()
+                return nil
+            }
+            ref := pushref{v.Pointer(), v.Type()}
+            if seen[ref] {
+                return errors.New("PUSH: cyclic value" + at(path))
+            }
+            seen[ref] = true
+            defer delete(seen, ref)
+            
+            this.Createtable(0, v.Len())
+            iter := v.MapRange()
+            for iter.Next() {
+                keypath := path + "[" + fmt.Sprint(iter.Key()) + "]"
+                if err := this.pushreflect(iter.Key(), seen, keypath); err != nil {
+                    return err
+                }
+                if this.Isnil(-1) || this.Isnumber(-1) && math.IsNaN(this.Tonumber(-1)) {
+                    return errors.New("PUSH: map key is nil or NaN" + at(keypath))
+                }
+                if err := this.pushreflect(iter.Value(), seen, keypath); err != nil {
+                    return err
+                }
+                this.Rawset(-3)
+            }
+        case reflect.Struct:
+            fields := luafields(v.Type())
+            this.Createtable(0, len(fields))
+            for _, field := range fields {
+                fv, err := v.FieldByIndexErr(field.index); if err != nil {
+                    // a nil embedded pointer has no fields to push
+                    continue
+                }
+                if err := this.pushreflect(fv, seen, path + "." + field.name); err != nil {
+                    return err
+                }
+                this.Setfield(-2, field.name)
+            }
+        case reflect.Ptr:
+            if v.IsNil() {
+                this.Pushnil()
+                return nil
+            }
+            ref := pushref{v.Pointer(), v.Type()}
+            if seen[ref] {
+                return errors.New("PUSH: cyclic value" + at(path))
+            }
+            seen[ref] = true
+            defer delete(seen, ref)
+            return this.pushreflect(v.Elem(), seen, path)
+        case reflect.Interface:
+            if v.IsNil() {
+                this.Pushnil()
+                return nil
+            }
+            return this.pushreflect(v.Elem(), seen, path)
+        default:
+            return errors.New("PUSH: cannot push go value of type " + v.Type().String() + at(path))
+    }
+    return nil
+}
+
+// pushsequence pushes the elements of the slice or array v as a sequence
+func (this *State) pushsequence(v reflect.Value, seen map[pushref]bool, path string) error {
+    this.Createtable(v.Len(), 0)
+    for i := 0; i < v.Len(); i++ {
+        if err := this.pushreflect(v.Index(i), seen, path + "[" + strconv.Itoa(i + 1) + "]"); err != nil {
+            return err
+        }
+        this.Rawseti(-2, i + 1)
+    }
+    return nil
+}
+
+// ToValue converts the lua value at the given index and stores it in the go value
+// dst points to. It is the reverse of Push:
+//
+// 	booleans      bool
+// 	numbers       ints, uints and floats. Ints and uints only hold whole numbers
+// 	              in their range
+// 	strings       string and []byte
+// 	tables        slices and arrays from the sequence of the table, maps, and
+// 	              structs from the fields named as in Push
+// 	nil           the zero value of pointers, maps, slices and interfaces
+// 	objects       their go pointer, see PushObject
+// 	any value     Value, and *Table, *Function, *Userdata or *Thread for values
+// 	              of their type, see State.Value
+//
+// Pointers are allocated as needed. Fields missing from a table leave the struct
+// field as is. An empty interface receives nil, bool, float64, string, []interface{}
+// for sequences and map[interface{}]interface{} for other tables.
+//
+// ToValue returns an error for values of other types than the destination expects,
+// for functions, other userdata and threads outside of Values, and for cyclic tables. dst may then be left
+// partially filled. The stack is left unchanged.
+func (this *State) ToValue(index int, dst interface{}) error {
+    v := reflect.ValueOf(dst)
+    if v.Kind() != reflect.Ptr || v.IsNil() {
+        return errors.New("TOVALUE: destination must be a non-nil pointer")
+    }
+    if index < 0 && index > LUA_REGISTRYINDEX {
+        index = this.Gettop() + index + 1
+    }
+    
+    return this.toreflect(index, v.Elem(), make(map[unsafe.Pointer]bool), "")
+}
+
+// toreflect stores the lua value at the absolute index in v, path locates the value
+// within the value given to ToValue for errors
+func (this *State) toreflect(index int, v reflect.Value, seen map[unsafe.Pointer]bool, path string) error {
+    if !this.Checkstack(3) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    luatype := this.Type(index)
+    
+    if _, ok := valuetypenames[v.Type()]; ok && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr || v.Kind() == reflect.Struct) {
+        return this.toluavalue(index, v, path)
+    }
+    if luatype == LUA_TNIL || luatype == LUA_TNONE {
+        switch v.Kind() {
+            case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+                v.Set(reflect.Zero(v.Type()))
+                return nil
+        }
+        return this.mismatch(index, v, path)
+    }
+    if luatype == LUA_TUSERDATA {
+        if obj := this.toobject(index); obj != nil && obj.value.Type().AssignableTo(v.Type()) {
+            v.Set(obj.value)
+            return nil
+        }
+    }
+    
+    switch v.Kind() {
+        case reflect.Ptr:
+            if v.IsNil() {
+                v.Set(reflect.New(v.Type().Elem()))
+            }
+            return this.toreflect(index, v.Elem(), seen, path)
+        case reflect.Interface:
+            if v.NumMethod() != 0 {
+                return this.mismatch(index, v, path)
+            }
+            value, err := this.togeneric(index, seen, path); if err != nil {
+                return err
+            }
+            if value == nil {
+                v.Set(reflect.Zero(v.Type()))
+            } else {
+                v.Set(reflect.ValueOf(value))
+            }
+        case reflect.Bool:
+            if luatype != LUA_TBOOLEAN {
+                return this.mismatch(index, v, path)
+            }
+            v.SetBool(this.Toboolean(index))
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            if luatype != LUA_TNUMBER {
+                return this.mismatch(index, v, path)
+            }
+            n := this.Tonumber(index)
+            if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 || v.OverflowInt(int64(n)) {
+                return errors.New("TOVALUE: number " + strconv.FormatFloat(n, 'g', -1, 64) +
+                    " does not fit in go value of type " + v.Type().String() + at(path))
+            }
+            v.SetInt(int64(n))
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            if luatype != LUA_TNUMBER {
+                return this.mismatch(index, v, path)
+            }
+            n := this.Tonumber(index)
+            if n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 || v.OverflowUint(uint64(n)) {
+                return errors.New("TOVALUE: number " + strconv.FormatFloat(n, 'g', -1, 64) +
+                    " does not fit in go value of type " + v.Type().String() + at(path))
+            }
+            v.SetUint(uint64(n))
+        case reflect.Float32, reflect.Float64:
+            if luatype != LUA_TNUMBER {
+                return this.mismatch(index, v, path)
+            }
+            v.SetFloat(this.Tonumber(index))
+        case reflect.String:
+            if luatype != LUA_TSTRING {
+                return this.mismatch(index, v, path)
+            }
+            v.SetString(string(this.Tolstring(index)))
+        case reflect.Slice:
+            if luatype == LUA_TSTRING && v.Type().Elem().Kind() == reflect.Uint8 {
+                v.SetBytes(this.Tolstring(index))
+                return nil
+            }
+            if luatype != LUA_TTABLE {
+                return this.mismatch(index, v, path)
+            }
+            n := this.Objlen(index)
+            slice := reflect.MakeSlice(v.Type(), n, n)
+            if err := this.tosequence(index, slice, seen, path); err != nil {
+                return err
+            }
+            v.Set(slice)
+        case reflect.Array:
+            if luatype != LUA_TTABLE {
+                return this.mismatch(index, v, path)
+            }
+            v.Set(reflect.Zero(v.Type()))
+            return this.tosequence(index, v, seen, path)
+        case reflect.Map:
+            if luatype != LUA_TTABLE {
+                return this.mismatch(index, v, path)
+            }
+            ptr := this.Topointer(index)
+            if seen[ptr] {
+                return errors.New("TOVALUE: cyclic table" + at(path))
+            }
+            seen[ptr] = true
+            defer delete(seen, ptr)
+            
+            if v.IsNil() {
+                v.Set(reflect.MakeMap(v.Type()))
+            }
+            this.Pushnil()
+            for this.Next(index) {
+                top := this.Gettop()
+                keypath := path + "[" + this.keystring(top - 1) + "]"
+                key := reflect.New(v.Type().Key()).Elem()
+                if err := this.toreflect(top - 1, key, seen, keypath); err != nil {
+                    this.Pop(2)
+                    return err
+                }
+                value := reflect.New(v.Type().Elem()).Elem()
+                if err := this.toreflect(top, value, seen, keypath); err != nil {
+                    this.Pop(2)
+                    return err
+                }
+                v.SetMapIndex(key, value)
+                this.Pop(1)
+            }
+        case reflect.Struct:
+            if luatype != LUA_TTABLE {
+                return this.mismatch(index, v, path)
+            }
+            ptr := this.Topointer(index)
+            if seen[ptr] {
+                return errors.New("TOVALUE: cyclic table" + at(path))
+            }
+            seen[ptr] = true
+            defer delete(seen, ptr)
+            
+            for _, field := range luafields(v.Type()) {
+                this.Getfield(index, field.name)
+                if this.Isnil(-1) {
+                    this.Pop(1)
+                    continue
+                }
+                err := this.toreflect(this.Gettop(), fieldbyindex(v, field.index), seen, path + "." + field.name)
+                this.Pop(1)
+                if err != nil {
+                    return err
+                }
+            }
+        default:
+            return this.mismatch(index, v, path)
+    }
+    return nil
+}
+
+// toluavalue stores the lua value at the absolute index in v, of type Value, Nil or a
+// pointer to a Table, Function, Userdata or Thread
+func (this *State) toluavalue(index int, v reflect.Value, path string) error {
+    value := this.Value(index)
+    if v.Type() == valuetype || reflect.TypeOf(value) == v.Type() {
+        v.Set(reflect.ValueOf(value))
+        return nil
+    }
+    if reference, ok := value.(interface{ Release() }); ok {
+        reference.Release()
+    }
+    if v.Kind() == reflect.Ptr && value.Type() == LUA_TNIL {
+        v.Set(reflect.Zero(v.Type()))
+        return nil
+    }
+    return this.mismatch(index, v, path)
+}
+
+// tosequence stores the sequence of the table at index in the slice or array v
+func (this *State) tosequence(index int, v reflect.Value, seen map[unsafe.Pointer]bool, path string) error {
+    ptr := this.Topointer(index)
+    if seen[ptr] {
+        return errors.New("TOVALUE: cyclic table" + at(path))
+    }
+    seen[ptr] = true
+    defer delete(seen, ptr)
+    
+    n := this.Objlen(index)
+    if n > v.Len() {
+        n = v.Len()
+    }
+    for i := 1; i <= n; i++ {
+        this.Rawgeti(index, i)
+        err := this.toreflect(this.Gettop(), v.Index(i - 1), seen, path + "[" + strconv.Itoa(i) + "]")
+        this.Pop(1)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// togeneric converts the lua value at the absolute index for an empty interface
+func (this *State) togeneric(index int, seen map[unsafe.Pointer]bool, path string) (interface{}, error) {
+    switch this.Type(index) {
+        case LUA_TNIL, LUA_TNONE:
+            return nil, nil
+        case LUA_TBOOLEAN:
+            return this.Toboolean(index), nil
+        case LUA_TNUMBER:
+            return this.Tonumber(index), nil
+        case LUA_TSTRING:
+            return string(this.Tolstring(index)), nil
+        case LUA_TTABLE:
+            // handled below
+        default:
+            return nil, errors.New("TOVALUE: cannot convert lua " + this.Typename(index) +
+                " to a go value" + at(path))
+    }
+    
+    ptr := this.Topointer(index)
+    if seen[ptr] {
+        return nil, errors.New("TOVALUE: cyclic table" + at(path))
+    }
+    seen[ptr] = true
+    defer delete(seen, ptr)
+    
+    table := make(map[interface{}]interface{})
+    this.Pushnil()
+    for this.Next(index) {
+        top := this.Gettop()
+        keypath := path + "[" + this.keystring(top - 1) + "]"
+        key, err := this.togeneric(top - 1, seen, keypath); if err != nil {
+            this.Pop(2)
+            return nil, err
+        }
+        value, err := this.togeneric(top, seen, keypath); if err != nil {
+            this.Pop(2)
+            return nil, err
+        }
+        if _, ok := key.(map[interface{}]interface{}); ok {
+            this.Pop(2)
+            return nil, errors.New("TOVALUE: cannot convert a table key to a go value" + at(keypath))
+        }
+        if _, ok := key.([]interface{}); ok {
+            this.Pop(2)
+            return nil, errors.New("TOVALUE: cannot convert a table key to a go value" + at(keypath))
+        }
+        table[key] = value
+        this.Pop(1)
+    }
+    
+    // tables holding exactly the keys 1 to n are sequences
+    n := this.Objlen(index)
+    if n == 0 || n != len(table) {
+        return table, nil
+    }
+    sequence := make([]interface{}, n)
+    for i := 1; i <= n; i++ {
+        value, ok := table[float64(i)]; if !ok {
+            return table, nil
+        }
+        sequence[i - 1] = value
+    }
+    return sequence, nil
+}
+
+// mismatch returns the error for a lua value of the wrong type for v
+func (this *State) mismatch(index int, v reflect.Value, path string) error {
+    return errors.New("TOVALUE: cannot convert lua " + this.Typename(index) +
+        " to go value of type " + v.Type().String() + at(path))
+}
+
+// keystring describes the table key at the absolute index for error paths, without
+// converting it in place as Tostring would
+func (this *State) keystring(index int) string {
+    switch this.Type(index) {
+        case LUA_TSTRING:
+            return strconv.Quote(this.Tostring(index))
+        case LUA_TNUMBER:
+            return strconv.FormatFloat(this.Tonumber(index), 'g', -1, 64)
+        default:
+            return this.Typename(index)
+    }
+}
+
+// at formats the path of a value for an error message
+func at(path string) string {
+    if path == "" {
+        return ""
+    }
+    return " at " + path
+}
+
+// luafields returns the fields of the struct type t marshaled by Push and ToValue
+func luafields(t reflect.Type) []luafield {
+    if fields, ok := structfields.Load(t); ok {
+        return fields.([]luafield)
+    }
+    
+    fields := []luafield{}
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := field.Tag.Get("lua")
+        if tag == "-" {
+            continue
+        }
+        
+        // the fields of embedded structs are fields of the table
+        fieldtype := field.Type
+        if fieldtype.Kind() == reflect.Ptr {
+            fieldtype = fieldtype.Elem()
+        }
+        if field.Anonymous && tag == "" && fieldtype.Kind() == reflect.Struct {
+            for _, embedded := range luafields(fieldtype) {
+                fields = append(fields, luafield{
+                    name: embedded.name,
+                    index: append([]int{i}, embedded.index...),
+                })
+            }
+            continue
+        }
+        
+        if field.PkgPath != "" {
+            continue
+        }
+        name := field.Name
+        if tag != "" {
+            name = strings.Split(tag, ",")[0]
+        }
+        fields = append(fields, luafield{name: name, index: []int{i}})
+    }
+    
+    structfields.Store(t, fields)
+    return fields
+}
+
+// fieldbyindex is reflect.Value.FieldByIndex allocating nil embedded pointers
+func fieldbyindex(v reflect.Value, index []int) reflect.Value {
+    for i, x := range index {
+        if i > 0 && v.Kind() == reflect.Ptr {
+            if v.IsNil() {
+                v.Set(reflect.New(v.Type().Elem()))
+            }
+            v = v.Elem()
+        }
+        v = v.Field(x)
+    }
+    return v
+}
\ No newline at end of file
@@ -0,0 +1,280 @@
+package luajit
+
+import(
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+    "unsafe"
+)
+
+// classkey prefixes the registry keys of the metatables of registered types
+const classkey = "goluajit.class."
+
+// A class is a go pointer type registered with RegisterType
+type class struct {
+    typ reflect.Type
+    
+    // name is the name of the type in lua errors and key the registry key of its
+    // metatable
+    name string
+    key string
+    
+    // fields are the struct fields read and written by __index and __newindex
+    fields map[string]luafield
+}
+
+// An object is a go pointer pushed with PushObject, as the value of a userdata made by
+// NewGouserdata.
+type object struct {
+    value reflect.Value
+    class *class
+}
+
+// RegisterType registers the go pointer type t, so that its values are pushed as
+// userdata by PushObject. A struct type registers the pointer to it.
+//
+// Exported methods are called with the : syntax, under their go name or the go name
+// with a lowercase first letter, so mu:Lock() and mu:lock() call the same method.
+// Their arguments and results are converted as for NewFunc, and a first parameter
+// of type *State receives the calling State. Exported fields, named as by Push, are
+// read and written by indexing the userdata, and hide the methods of the same name:
+//
+// 	obj.Name = "x"
+// 	print(obj.Name, obj:describe())
+//
+// Reading a field pushes a copy of it, as Push does, unless it is a pointer of a
+// registered type. The metatable of t is kept in the registry, shared by all the
+// values of t, and getmetatable returns the name of t instead of it, so lua code
+// cannot replace the methods. Registering a type again has no effect.
+//
+// Methods must be called with the : syntax. A call such as obj.describe() passes no
+// receiver and raises an error.
+func (this *State) RegisterType(t reflect.Type) error {
+    _, err := this.registerclass(t)
+    return err
+}
+
+// PushObject pushes the go pointer obj onto the stack as a userdata, registering its
+// type with RegisterType if needed. The userdata holds a reference to obj until lua
+// collects it.
+//
+// Pushing the same pointer twice pushes two userdata, which are equal under ==.
+// Values of registered types are also pushed as objects by Push, and ToValue and
+// NewFunc convert objects back to their go pointer.
+func (this *State) PushObject(obj interface{}) error {
+    v := reflect.ValueOf(obj)
+    if v.Kind() != reflect.Ptr || v.IsNil() {
+        return errors.New("OBJECT: expected a non-nil pointer, got " + fmt.Sprintf("%T", obj))
+    }
+    
+    class, err := this.registerclass(v.Type()); if err != nil {
+        return err
+    }
+    class.push(this, v)
+    return nil
+}
+
+// registerclass returns the class of t, registering it on the first call
+func (this *State) registerclass(t reflect.Type) (*class, error) {
+    if t == nil {
+        return nil, errors.New("OBJECT: expected a pointer or struct type, got nil")
+    }
+    if t.Kind() == reflect.Struct {
+        t = reflect.PtrTo(t)
+    }
+    if t.Kind() != reflect.Ptr {
+        return nil, errors.New("OBJECT: expected a pointer or struct type, got " + t.String())
+    }
+    
+    root := this.root()
+    if registered, ok := root.classes[t]; ok {
+        return registered, nil
+    }
+    if !this.Checkstack(4) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    newclass := &class{
+        typ: t,
+        name: t.String(),
+        key: classkey + t.String(),
+        fields: map[string]luafield{},
+    }
+    this.Getfield(LUA_REGISTRYINDEX, newclass.key)
+    taken := !this.Isnil(-1)
+    this.Pop(1)
+    if taken {
+        return nil, errors.New("OBJECT: another type is registered as " + newclass.name)
+    }
+    if t.Elem().Kind() == reflect.Struct {
+        for _, field := range luafields(t.Elem()) {
+            newclass.fields[field.name] = field
+        }
+    }
+    
+    this.Newtable()
+    
+    // Push name
+    this.Pushstring(newclass.name)
+    this.Setfield(-2, "__name")
+    
+    // Push the methods, shared by all values
+    this.Newtable()
+    for i := 0; i < t.NumMethod(); i++ {
+        method := t.Method(i)
+        this.Pushfunction(newfuncadapter(method.Func, FuncOptions{}, newclass).call)
+        this.Pushvalue(-1)
+        this.Setfield(-3, method.Name)
+        this.Setfield(-2, lowerfirst(method.Name))
+    }
+    this.Setfield(-2, "__methods")
+    
+    // Push __index
+    this.Pushfunction(newclass.index)
+    this.Setfield(-2, "__index")
+    
+    // Push __newindex
+    this.Pushfunction(newclass.newindex)
+    this.Setfield(-2, "__newindex")
+    
+    // Push __tostring
+    this.Pushfunction(newclass.tostring)
+    this.Setfield(-2, "__tostring")
+    
+    // Push __eq
+    this.Pushfunction(newclass.eq)
+    this.Setfield(-2, "__eq")
+    
+    // Protect the metatable, so lua code cannot reach the shared methods
+    this.Pushstring(newclass.name)
+    this.Setfield(-2, "__metatable")
+    
+    this.Setfield(LUA_REGISTRYINDEX, newclass.key)
+    
+    if root.classes == nil {
+        root.classes = make(map[reflect.Type]*class)
+    }
+    root.classes[t] = newclass
+    return newclass, nil
+}
+
+// push pushes the pointer v of the class as a new userdata
+func (this *class) push(ls *State, v reflect.Value) {
+    ls.NewGouserdata(&object{value: v, class: this}, this.key)
+}
+
+// toobject returns the object at the given index, or nil if the value is not an
+// object of this state. The class is found from the type the userdata was pushed as,
+// never from its metatable.
+func (this *State) toobject(index int) *object {
+    ud, ok := this.togouserdata(index); if !ok || !strings.HasPrefix(ud.typename, classkey) {
+        return nil
+    }
+    obj, _ := ud.value.(*object)
+    return obj
+}
+
+// check returns the pointer held by the object of the class at narg, raising an
+// argument error for other values
+func (this *class) check(ls *State, narg int) reflect.Value {
+    obj := ls.toobject(narg)
+    if obj == nil || obj.class != this {
+        ls.Typeerror(narg, this.name)
+    }
+    return obj.value
+}
+
+// index is the __index metamethod of the class
+func (this *class) index(ls *State) int {
+    v := this.check(ls, 1)
+    if ls.Type(2) != LUA_TSTRING {
+        ls.Pushnil()
+        return 1
+    }
+    name := ls.Tostring(2)
+    
+    if field, ok := this.fields[name]; ok {
+        fieldvalue, ok := fieldbypath(v.Elem(), field.index); if !ok {
+            ls.Pushnil()
+            return 1
+        }
+        if err := ls.pushreflect(fieldvalue, make(map[pushref]bool), ""); err != nil {
+            ls.Pushstring("cannot get field '" + name + "' of " + this.name + " (" + strings.TrimPrefix(err.Error(), "PUSH: ") + ")")
+            ls.Error()
+        }
+        return 1
+    }
+    
+    ls.Getmetatable(1)
+    ls.Getfield(-1, "__methods")
+    ls.Getfield(-1, name)
+    return 1
+}
+
+// newindex is the __newindex metamethod of the class
+func (this *class) newindex(ls *State) int {
+    v := this.check(ls, 1)
+    name := ls.Tostring(2)
+    
+    field, ok := this.fields[name]
+    if !ok || ls.Type(2) != LUA_TSTRING {
+        ls.Pushstring("cannot set field '" + name + "' of " + this.name)
+        ls.Error()
+    }
+    fieldvalue := fieldbyindex(v.Elem(), field.index)
+    if !fieldvalue.CanSet() {
+        ls.Pushstring("cannot set field '" + name + "' of " + this.name)
+        ls.Error()
+    }
+    
+    // convert to a new value first, so a failed conversion leaves the field unchanged
+    newvalue := reflect.New(fieldvalue.Type()).Elem()
+    if err := ls.toreflect(3, newvalue, make(map[unsafe.Pointer]bool), ""); err != nil {
+        ls.Pushstring("cannot set field '" + name + "' of " + this.name + " (" + strings.TrimPrefix(err.Error(), "TOVALUE: ") + ")")
+        ls.Error()
+    }
+    fieldvalue.Set(newvalue)
+    return 0
+}
+
+// tostring is the __tostring metamethod of the class, using the String method of
+// values implementing fmt.Stringer
+func (this *class) tostring(ls *State) int {
+    v := this.check(ls, 1)
+    if stringer, ok := v.Interface().(fmt.Stringer); ok {
+        ls.Pushstring(stringer.String())
+    } else {
+        ls.Pushstring(fmt.Sprintf("%s: %p", this.name, v.Interface()))
+    }
+    return 1
+}
+
+// eq is the __eq metamethod of the class, comparing the pointers of the objects
+func (this *class) eq(ls *State) int {
+    a, b := ls.toobject(1), ls.toobject(2)
+    ls.Pushboolean(a != nil && b != nil && a.value.Pointer() == b.value.Pointer())
+    return 1
+}
+
+// fieldbypath is reflect.Value.FieldByIndex returning false for nil embedded pointers
+func fieldbypath(v reflect.Value, index []int) (reflect.Value, bool) {
+    for i, x := range index {
+        if i > 0 && v.Kind() == reflect.Ptr {
+            if v.IsNil() {
+                return reflect.Value{}, false
+            }
+            v = v.Elem()
+        }
+        v = v.Field(x)
+    }
+    return v, true
+}
+
+// lowerfirst returns name with a lowercase first letter
+func lowerfirst(name string) string {
+    r, size := utf8.DecodeRuneInString(name)
+    return string(unicode.ToLower(r)) + name[size:]
+}
\ No newline at end of file
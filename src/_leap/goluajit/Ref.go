@@ -0,0 +1,94 @@
+package luajit
+
+import(
+    "runtime"
+)
+
+// A Ref pins a lua value in the registry, so that go code can keep it across calls,
+// such as a lua function to call back from a timer or a table shared with a handler.
+// The value cannot be collected until the Ref is released.
+//
+// Release the Ref once the value is no longer needed. A Ref that go collects without
+// being released is released by the next Lock or NewRef of its state, as the go
+// finalizer does not hold the Gil. Refs do not survive their state: after Close,
+// Push and Release must not be called.
+type Ref struct {
+    state *State
+    ref int
+}
+
+// NewRef returns a Ref to the value at the given index, which is left on the stack.
+// Push pushes the value onto the stack of this State, so a Ref kept by a go function
+// of a thread should be made with a State that outlives the call, such as the root
+// State or a thread kept for callbacks.
+func (this *State) NewRef(index int) *Ref {
+    if !this.Checkstack(1) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    this.releaserefs()
+    
+    this.Pushvalue(index)
+    ref := &Ref{state: this, ref: this.Ref(LUA_REGISTRYINDEX)}
+    runtime.SetFinalizer(ref, (*Ref).finalize)
+    return ref
+}
+
+// Push pushes the value of the Ref onto the stack of the State it was made with, or
+// nil once the Ref is released. The Gil must be held.
+func (this *Ref) Push() {
+    if !this.state.Checkstack(1) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    if this.ref == LUA_NOREF {
+        this.state.Pushnil()
+        return
+    }
+    this.state.Rawgeti(LUA_REGISTRYINDEX, this.ref)
+}
+
+// Release unpins the value of the Ref, so that lua may collect it. Releasing a Ref
+// again has no effect. The Gil must be held.
+func (this *Ref) Release() {
+    if this.ref == LUA_NOREF {
+        return
+    }
+    runtime.SetFinalizer(this, nil)
+    
+    this.state.Unref(LUA_REGISTRYINDEX, this.ref)
+    this.ref = LUA_NOREF
+}
+
+// Released returns whether the Ref was released.
+func (this *Ref) Released() bool {
+    return this.ref == LUA_NOREF
+}
+
+// finalize queues the reference of a Ref collected by go for release by its state
+func (this *Ref) finalize() {
+    stateval, ok := rootstates.Load(this.state.gvindex); if !ok {
+        return
+    }
+    root := stateval.(*State)
+    
+    root.refmutex.Lock()
+    defer root.refmutex.Unlock()
+    root.releasedrefs = append(root.releasedrefs, this.ref)
+}
+
+// releaserefs releases the references of the Refs collected by go. The Gil must be
+// held.
+func (this *State) releaserefs() {
+    root := this.root()
+    if root.dead {
+        return
+    }
+    
+    root.refmutex.Lock()
+    refs := root.releasedrefs
+    root.releasedrefs = nil
+    root.refmutex.Unlock()
+    
+    for _, ref := range refs {
+        this.Unref(LUA_REGISTRYINDEX, ref)
+    }
+}
\ No newline at end of file
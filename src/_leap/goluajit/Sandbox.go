@@ -0,0 +1,306 @@
+package luajit
+
+import(
+    "bufio"
+    "errors"
+    "os"
+    "strings"
+    "unsafe"
+)
+
+/*
+#include <lua.h>
+#include <stdlib.h>
+
+extern void goluajit_openlib(lua_State*, const char*);
+*/
+import "C"
+
+// sandboxkey is the registry key of the table holding the functions a sandbox replaced
+const sandboxkey = "goluajit.sandbox"
+
+// sandboxlibs are the library names a Sandbox may open
+var sandboxlibs map[string]bool = map[string]bool{
+    "base": true, "package": true, "table": true, "io": true, "os": true, "string": true,
+    "math": true, "debug": true, "bit": true, "jit": true, "ffi": true,
+}
+
+// errbinarychunk is returned by the sandboxed load functions for precompiled chunks
+var errbinarychunk error = errors.New("attempt to load a binary chunk")
+
+// Sandbox is a policy restricting what the lua code run by a State may do. It is set
+// with Options.Sandbox and applied by Openlibs, so the host must open the libraries
+// with Openlibs before running untrusted code.
+//
+// A sandbox restricts the global state as a whole. Chunks that should not see each
+// other's globals also need their own environment, see Newenv.
+type Sandbox struct {
+    // Libs are the standard libraries Openlibs opens: "base", "package", "table",
+    // "io", "os", "string", "math", "debug", "bit", "jit" and "ffi". The ffi library
+    // is loaded with require, so it must be listed in Modules as well.
+    Libs []string
+    
+    // Modules are the modules of package.preload require may load, such as those
+    // pushed with Pushmodule. Sandboxed code cannot require other modules, as require
+    // does not search package.path and package.cpath, and package.loadlib is removed.
+    Modules []string
+    
+    // Deny are the globals, or fields of global tables, removed once the libraries
+    // are open, such as "os.execute" or "dofile".
+    Deny []string
+    
+    // Bytecode allows load, loadstring, loadfile and dofile to load precompiled
+    // chunks. Luajit does not verify bytecode, so untrusted code must not load it.
+    Bytecode bool
+}
+
+// validate checks that the sandbox only names known libraries
+func (this *Sandbox) validate() error {
+    for _, lib := range this.Libs {
+        if !sandboxlibs[lib] {
+            return errors.New("SANDBOX: unknown library " + lib)
+        }
+    }
+    return nil
+}
+
+// allows returns whether require may load the module name
+func (this *Sandbox) allows(name string) bool {
+    for _, module := range this.Modules {
+        if module == name {
+            return true
+        }
+    }
+    return false
+}
+
+// open opens the libraries of the sandbox and restricts them
+func (this *Sandbox) open(ls *State) {
+    if !ls.Checkstack(4) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    for _, lib := range this.Libs {
+        cs := C.CString(lib)
+        C.goluajit_openlib(ls.luastate, cs)
+        C.free(unsafe.Pointer(cs))
+    }
+    
+    // Only load modules from package.preload
+    ls.Getglobal("package")
+    if ls.Istable(-1) {
+        ls.Newtable()
+        ls.Pushfunction(this.preloader)
+        ls.Rawseti(-2, 1)
+        ls.Setfield(-2, "loaders")
+        ls.Pushnil()
+        ls.Setfield(-2, "loadlib")
+    }
+    ls.Pop(1)
+    
+    // Replace the load functions with ones refusing bytecode, keeping the originals
+    if !this.Bytecode {
+        loaders := map[string]Gofunction{
+            "load": this.load,
+            "loadstring": this.loadstring,
+            "loadfile": this.loadfile,
+            "dofile": this.dofile,
+        }
+        ls.Newtable()
+        for name, fn := range loaders {
+            ls.Getglobal(name)
+            if ls.Isnil(-1) {
+                ls.Pop(1)
+                continue
+            }
+            ls.Setfield(-2, name)
+            ls.Pushfunction(fn)
+            ls.Setglobal(name)
+        }
+        ls.Setfield(LUA_REGISTRYINDEX, sandboxkey)
+    }
+    
+    for _, name := range this.Deny {
+        if dot := strings.Index(name, "."); dot >= 0 {
+            ls.Getglobal(name[:dot])
+            if ls.Istable(-1) {
+                ls.Pushnil()
+                ls.Setfield(-2, name[dot + 1:])
+            }
+            ls.Pop(1)
+        } else {
+            ls.Pushnil()
+            ls.Setglobal(name)
+        }
+    }
+}
+
+// preloader is the only entry of package.loaders in a sandbox. It returns the loader
+// of package.preload for the modules of the sandbox.
+func (this *Sandbox) preloader(ls *State) int {
+    name := ls.Tostring(1)
+    if !this.allows(name) {
+        ls.Pushstring("\n\tmodule '" + name + "' is not allowed in the sandbox")
+        return 1
+    }
+    
+    ls.Getfield(LUA_REGISTRYINDEX, "_PRELOAD")
+    if !ls.Istable(-1) {
+        ls.Pushstring("\n\tno field package.preload['" + name + "']")
+        return 1
+    }
+    ls.Getfield(-1, name)
+    if ls.Isnil(-1) {
+        ls.Pushstring("\n\tno field package.preload['" + name + "']")
+    }
+    return 1
+}
+
+// callreplaced calls the function the sandbox replaced with the arguments on the stack
+// and returns its results, raising its errors
+func (this *Sandbox) callreplaced(ls *State, name string) int {
+    nargs := ls.Gettop()
+    if !ls.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    ls.Getfield(LUA_REGISTRYINDEX, sandboxkey)
+    ls.Getfield(-1, name)
+    ls.Remove(-2)
+    ls.Insert(1)
+    
+    if ls.Pcall(nargs, LUA_MULTRET, 0) != nil {
+        ls.Error()
+    }
+    return ls.Gettop()
+}
+
+// fail returns nil and the message of err, as the load functions do
+func (this *Sandbox) fail(ls *State, err error) int {
+    ls.Pushnil()
+    ls.Pushstring(err.Error())
+    return 2
+}
+
+// loadstring is loadstring refusing bytecode
+func (this *Sandbox) loadstring(ls *State) int {
+    if isbinarychunk(ls.Tostring(1)) {
+        return this.fail(ls, errbinarychunk)
+    }
+    return this.callreplaced(ls, "loadstring")
+}
+
+// load is load refusing bytecode. The pieces of the chunk are read first, then
+// loaded with loadstring.
+func (this *Sandbox) load(ls *State) int {
+    if !ls.Isfunction(1) {
+        return this.callreplaced(ls, "load")
+    }
+    if !ls.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    pieces := []string{}
+    for {
+        ls.Pushvalue(1)
+        if ls.Pcall(0, 1, 0) != nil {
+            ls.Pushnil()
+            ls.Insert(-2)
+            return 2
+        }
+        if ls.Isnil(-1) || ls.Isstring(-1) && ls.Tostring(-1) == "" {
+            ls.Pop(1)
+            break
+        }
+        if !ls.Isstring(-1) {
+            return this.fail(ls, errors.New("reader function must return a string"))
+        }
+        pieces = append(pieces, ls.Tostring(-1))
+        ls.Pop(1)
+    }
+    
+    chunkname := "=(load)"
+    if ls.Isstring(2) {
+        chunkname = ls.Tostring(2)
+    }
+    ls.Settop(0)
+    ls.Pushstring(strings.Join(pieces, ""))
+    ls.Pushstring(chunkname)
+    return this.loadstring(ls)
+}
+
+// loadfile is loadfile refusing bytecode
+func (this *Sandbox) loadfile(ls *State) int {
+    if ls.Isstring(1) && isbinaryfile(ls.Tostring(1)) {
+        return this.fail(ls, errbinarychunk)
+    }
+    return this.callreplaced(ls, "loadfile")
+}
+
+// dofile is dofile refusing bytecode
+func (this *Sandbox) dofile(ls *State) int {
+    if ls.Isstring(1) && isbinaryfile(ls.Tostring(1)) {
+        ls.Pushstring(errbinarychunk.Error())
+        ls.Error()
+    }
+    return this.callreplaced(ls, "dofile")
+}
+
+// isbinarychunk returns whether the chunk is precompiled
+func isbinarychunk(chunk string) bool {
+    return strings.HasPrefix(chunk, "\033")
+}
+
+// isbinaryfile returns whether the file holds a precompiled chunk, after the first
+// line skipped by loadfile when it starts with a #
+func isbinaryfile(filename string) bool {
+    file, err := os.Open(filename); if err != nil {
+        return false
+    }
+    defer file.Close()
+    
+    reader := bufio.NewReader(file)
+    c, err := reader.ReadByte()
+    if err == nil && c == '#' {
+        if _, err = reader.ReadString('\n'); err == nil {
+            c, err = reader.ReadByte()
+        }
+    }
+    return err == nil && c == '\033'
+}
+
+// Creates a new environment table for a chunk and pushes it onto the stack. Reading
+// a global missing from the environment reads the global table, while globals the
+// chunk sets stay in its environment. Set the environment of a loaded chunk with
+// Setfenv:
+//
+// 	s.Loadstring(chunk)
+// 	s.Newenv()
+// 	s.Setfenv(-2)
+//
+// Tables shared through the global table, such as the libraries, are still shared.
+func (this *State) Newenv() {
+    if !this.Checkstack(3) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    this.Newtable()
+    this.Newtable()
+    this.Pushvalue(LUA_GLOBALSINDEX)
+    this.Setfield(-2, "__index")
+    this.Setmetatable(-2)
+}
+
+// Loadsource loads the lua code in source like Loadstring, but refuses precompiled 
+// chunks as the sandboxed load functions do when the sandbox of the state does not 
+// allow Bytecode. Hosts load code given by sandboxed lua code with it, such as the 
+// code of a new state. Like Loadbuffer, source may hold embedded zeros.
+func (this *State) Loadsource(source string) error {
+    if sandbox := this.Sandbox(); sandbox != nil && !sandbox.Bytecode && isbinarychunk(source) {
+        return errors.New("SANDBOX: " + errbinarychunk.Error())
+    }
+    return this.Loadbuffer([]byte(source), source)
+}
+
+// Sandbox returns the sandbox of the state, or nil if it has none.
+func (this *State) Sandbox() *Sandbox {
+    return this.root().sandbox
+}
\ No newline at end of file
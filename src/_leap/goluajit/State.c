@@ -1,42 +1,510 @@
 #include <lua.h>
 #include <lauxlib.h>
+#include <lualib.h>
 #include <stddef.h>
+#include <stdint.h>
 #include <stdlib.h>
 #include <string.h>
-#include "luauser.h"
 #include "_cgo_export.h"
 
+// registry key holding the gvindex of the golang State owning a lua global state
+#define GOLUAJIT_STATEKEY "goluajit.state"
+
+// registry key of the metatable of goluajit_closure userdata
+#define GOLUAJIT_CLOSUREMT "goluajit.closure"
+
+// registry key holding the GovalueRegistry index of the golang Hook of a lua global state
+#define GOLUAJIT_HOOKKEY "goluajit.hook"
+
+// registry key of the message handler of Pcall, created once so pushing it never allocates
+#define GOLUAJIT_MSGHANDLER "goluajit.msghandler"
+
+// goluajit_closure is the first upvalue of every go closure. It holds plain integer
+// handles, never go pointers, so they are exact at any size
+typedef struct {
+    uintptr_t stateindex;
+    uintptr_t funcindex;
+} goluajit_closure;
+
 static int goluajit_panicf(lua_State *s);
+static int goluajit_closuregc(lua_State *s);
+static int goluajit_msghandler(lua_State *s);
 
-void goluajit_luainit(lua_State *s)
+void goluajit_luainit(lua_State *s, int stateindex)
 {
-    printf("%s\n","goluajit_luainit");
+    lua_pushinteger(s, stateindex);
+    lua_setfield(s, LUA_REGISTRYINDEX, GOLUAJIT_STATEKEY);
+    
+    luaL_newmetatable(s, GOLUAJIT_CLOSUREMT);
+    lua_pushcfunction(s, goluajit_closuregc);
+    lua_setfield(s, -2, "__gc");
+    lua_pop(s, 1);
+    
+    lua_pushcfunction(s, goluajit_msghandler);
+    lua_setfield(s, LUA_REGISTRYINDEX, GOLUAJIT_MSGHANDLER);
+    
     lua_atpanic(s, goluajit_panicf);
 }
 
+void goluajit_openlib(lua_State *s, const char *name)
+{
+    static const luaL_Reg libs[] = {
+        {"base", luaopen_base},
+        {LUA_LOADLIBNAME, luaopen_package},
+        {LUA_TABLIBNAME, luaopen_table},
+        {LUA_IOLIBNAME, luaopen_io},
+        {LUA_OSLIBNAME, luaopen_os},
+        {LUA_STRLIBNAME, luaopen_string},
+        {LUA_MATHLIBNAME, luaopen_math},
+        {LUA_DBLIBNAME, luaopen_debug},
+        {LUA_BITLIBNAME, luaopen_bit},
+        {LUA_JITLIBNAME, luaopen_jit},
+        {NULL, NULL}
+    };
+    const luaL_Reg *lib;
+    
+    // open a single standard library the way luaL_openlibs does. The ffi library is
+    // only added to package.preload, to be loaded with require
+    if (strcmp(name, LUA_FFILIBNAME) == 0) {
+        luaL_findtable(s, LUA_REGISTRYINDEX, "_PRELOAD", 1);
+        lua_pushcfunction(s, luaopen_ffi);
+        lua_setfield(s, -2, LUA_FFILIBNAME);
+        lua_pop(s, 1);
+        return;
+    }
+    for (lib = libs; lib->func; lib++) {
+        if (strcmp(name, lib->name) == 0) {
+            lua_pushcfunction(s, lib->func);
+            lua_pushstring(s, lib == libs ? "" : lib->name);
+            lua_call(s, 1, 0);
+            return;
+        }
+    }
+}
+
+// goluajit_allocator wraps the allocator of a lua global state, counting the bytes it
+// holds and failing allocations past limit. A limit of 0 means no limit
+typedef struct {
+    lua_Alloc f;
+    void *ud;
+    size_t limit;
+    size_t current;
+    size_t peak;
+} goluajit_allocator;
+
+static void *goluajit_alloc(void *ud, void *ptr, size_t osize, size_t nsize)
+{
+    goluajit_allocator *allocator;
+    void *p;
+    
+    // lua raises a LUA_ERRMEM error when an allocation returns NULL. Frees and shrinks 
+    // never fail
+    allocator = (goluajit_allocator*)ud;
+    if (nsize > osize && allocator->limit > 0 && allocator->current + nsize - osize > allocator->limit) {
+        return NULL;
+    }
+    
+    p = allocator->f(allocator->ud, ptr, osize, nsize);
+    if (p == NULL && nsize > 0) {
+        return NULL;
+    }
+    allocator->current = allocator->current + nsize - osize;
+    if (allocator->current > allocator->peak) {
+        allocator->peak = allocator->current;
+    }
+    return p;
+}
+
+void *goluajit_newallocator(lua_State *s)
+{
+    goluajit_allocator *allocator;
+    
+    // wrap the current allocator rather than replacing it: on 64 bit targets luajit 
+    // objects must be allocated by its own allocator. Counting starts from the bytes
+    // the state already holds
+    allocator = (goluajit_allocator*)malloc(sizeof(goluajit_allocator));
+    if (allocator == NULL) {
+        return NULL;
+    }
+    allocator->f = lua_getallocf(s, &allocator->ud);
+    allocator->limit = 0;
+    allocator->current = (size_t)lua_gc(s, LUA_GCCOUNT, 0) * 1024 + (size_t)lua_gc(s, LUA_GCCOUNTB, 0);
+    allocator->peak = allocator->current;
+    lua_setallocf(s, goluajit_alloc, allocator);
+    return allocator;
+}
+
+void goluajit_closeallocator(lua_State *s, void *ud)
+{
+    goluajit_allocator *allocator;
+    
+    // restore the wrapped allocator before lua_close, luajit only releases the memory
+    // of its own allocator when it is still installed
+    allocator = (goluajit_allocator*)ud;
+    lua_setallocf(s, allocator->f, allocator->ud);
+    free(allocator);
+}
+
+void goluajit_setmemorylimit(void *ud, size_t limit)
+{
+    ((goluajit_allocator*)ud)->limit = limit;
+}
+
+void goluajit_collectgarbage(lua_State *s, void *ud)
+{
+    goluajit_allocator *allocator;
+    size_t limit;
+    
+    // run a full collection with the limit lifted: the collector itself allocates, and 
+    // an error outside of any protected call would kill the state
+    allocator = (goluajit_allocator*)ud;
+    limit = allocator->limit;
+    allocator->limit = 0;
+    lua_gc(s, LUA_GCCOLLECT, 0);
+    allocator->limit = limit;
+}
+
+void goluajit_memorystats(void *ud, size_t *current, size_t *peak, size_t *limit)
+{
+    goluajit_allocator *allocator;
+    
+    allocator = (goluajit_allocator*)ud;
+    *current = allocator->current;
+    *peak = allocator->peak;
+    *limit = allocator->limit;
+}
+
 static int goluajit_panicf(lua_State *s)
 {
-    printf("%s\n", "Oh Shit Happened!");    
+    int stateindex;
+    
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_STATEKEY);
+    stateindex = (int)lua_tointeger(s, -1);
+    lua_pop(s, 1);
+    
+    // Call back into golang luajit.dopanic. It does not return, but unwinds to the go
+    // code that entered lua with a go panic, so luajit never aborts the process
+    dopanic(s, stateindex);
     return 0;
 }    
 
+// docallback returns GOLUAJIT_CALLBACKERROR when the Gofunction raised an error or
+// panicked. The error value is then at the top of the stack. It must differ from the 
+// -1 returned by lua_yield.
+#define GOLUAJIT_CALLBACKERROR -2
+
 static int goluajit_closurecallback(lua_State *s)
 {
-	float stateindex;
-    float funcindex;
+	goluajit_closure *closure;
+    int r;
+    
+    // pull our State and Gofunction handles from the closure's first upvalue
+    closure = (goluajit_closure*)lua_touserdata(s, lua_upvalueindex(1));
+    
+    // Call back into golang luajit.docallback with the calling thread
+	r = docallback(s, closure->stateindex, closure->funcindex);
+    
+    // Raise errors only now that the go frames have returned, never longjmp over them
+    if (r == GOLUAJIT_CALLBACKERROR) {
+        return lua_error(s);
+    }
+    return r;
+}
+
+static int goluajit_closuregc(lua_State *s)
+{
+    goluajit_closure *closure;
+    
+    // the closure is being collected, release its Gofunction
+    closure = (goluajit_closure*)lua_touserdata(s, 1);
+    dorelease(closure->stateindex, closure->funcindex);
+    return 0;
+}
+
+void goluajit_pushclosure(lua_State *s, uintptr_t stateindex, uintptr_t funcindex, int n)
+{
+    goluajit_closure *closure;
+    
+	// pass a goluajit_closurecallback with a goluajit_closure upvalue inserted below 
+    // the n upvalues previously pushed by the caller. It holds:
+    // stateindex: the gvindex of our golang root State struct
+    // funcindex: the index of our golang Gofunction func in the State function table
+    closure = (goluajit_closure*)lua_newuserdata(s, sizeof(goluajit_closure));
+    closure->stateindex = stateindex;
+    closure->funcindex = funcindex;
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_CLOSUREMT);
+    lua_setmetatable(s, -2);
+    lua_insert(s, -(n + 1));
+    lua_pushcclosure(s, goluajit_closurecallback, n + 1);
+}
+
+static int goluajit_gccallback(lua_State *s)
+{
+    goluajit_closure *closure;
+    int r;
+    
+    // the upvalue has no metatable, so the Gofunction is only released here, after it 
+    // was called
+    closure = (goluajit_closure*)lua_touserdata(s, lua_upvalueindex(1));
+    r = docallback(s, closure->stateindex, closure->funcindex);
+    dorelease(closure->stateindex, closure->funcindex);
+    
+    if (r == GOLUAJIT_CALLBACKERROR) {
+        return lua_error(s);
+    }
+    return r;
+}
+
+void goluajit_pushgcclosure(lua_State *s, uintptr_t stateindex, uintptr_t funcindex)
+{
+    goluajit_closure *closure;
+    
+    // push a goluajit_gccallback for use as a __gc metamethod. Go closures may not be used
+    // there: a collected object and its __gc closure are finalized in the same cycle, in 
+    // no particular order, so the closure may release its Gofunction before it is called
+    closure = (goluajit_closure*)lua_newuserdata(s, sizeof(goluajit_closure));
+    closure->stateindex = stateindex;
+    closure->funcindex = funcindex;
+    lua_pushcclosure(s, goluajit_gccallback, 1);
+}
+
+void goluajit_pushfixedclosure(lua_State *s, uintptr_t stateindex, uintptr_t funcindex)
+{
+    goluajit_closure *closure;
+    
+    // push a goluajit_closurecallback whose Gofunction is never released, as its upvalue
+    // has no metatable. Named metatables use them, so their metamethods stay callable
+    // while lua_close finalizes the objects in any order
+    closure = (goluajit_closure*)lua_newuserdata(s, sizeof(goluajit_closure));
+    closure->stateindex = stateindex;
+    closure->funcindex = funcindex;
+    lua_pushcclosure(s, goluajit_closurecallback, 1);
+}
+
+// goluajit_object is the block of the userdata pushed by NewGouserdata. It holds the
+// GovalueRegistry index of the go value, never a go pointer, and the address of 
+// goluajit_objectmark, which tells objects apart from other userdata of the same size
+typedef struct {
+    const char *mark;
+    uintptr_t objectindex;
+} goluajit_object;
+
+static const char goluajit_objectmark = 0;
+
+// goluajit_checkobject returns the object at index, or NULL if the value is not a 
+// userdata pushed by goluajit_newobject
+static goluajit_object *goluajit_checkobject(lua_State *s, int index)
+{
+    goluajit_object *object;
+    
+    if (lua_type(s, index) != LUA_TUSERDATA || lua_objlen(s, index) != sizeof(goluajit_object)) {
+        return NULL;
+    }
+    object = (goluajit_object*)lua_touserdata(s, index);
+    if (object->mark != &goluajit_objectmark) {
+        return NULL;
+    }
+    return object;
+}
+
+static int goluajit_objectgc(lua_State *s)
+{
+    goluajit_object *object;
+    uintptr_t stateindex;
     
-    // pull our GovalueRegistry indexes from the closure's upvalues
-    stateindex = lua_tonumber(s, lua_upvalueindex(1));
-    funcindex = lua_tonumber(s, lua_upvalueindex(2));
+    // the __gc of the metatables of userdata holding go values. It is a plain C 
+    // function, so it stays callable while lua_close finalizes the objects in any order.
+    // Lua code may give the metatable to other userdata, which hold no go value
+    object = goluajit_checkobject(s, 1);
+    if (object == NULL) {
+        return 0;
+    }
+    
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_STATEKEY);
+    stateindex = (uintptr_t)lua_tointeger(s, -1);
+    lua_pop(s, 1);
+    doobjectgc(stateindex, object->objectindex);
+    return 0;
+}
+
+void goluajit_pushobjectgc(lua_State *s)
+{
+    lua_pushcfunction(s, goluajit_objectgc);
+}
+
+void goluajit_newobject(lua_State *s, uintptr_t objectindex)
+{
+    goluajit_object *object;
+    
+    object = (goluajit_object*)lua_newuserdata(s, sizeof(goluajit_object));
+    object->mark = &goluajit_objectmark;
+    object->objectindex = objectindex;
+}
+
+uintptr_t goluajit_toobject(lua_State *s, int index)
+{
+    goluajit_object *object;
+    
+    // the GovalueRegistry index held by the object at index, or 0 when the value is 
+    // not an object
+    object = goluajit_checkobject(s, index);
+    if (object == NULL) {
+        return 0;
+    }
+    return object->objectindex;
+}
+
+static void goluajit_hookf(lua_State *s, lua_Debug *ar)
+{
+    uintptr_t stateindex;
+    uintptr_t hookindex;
+    int r;
+    
+    // pull our State and Hook handles from the registry. Luajit hooks are set on the
+    // global state, so they are shared by all of its threads
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_STATEKEY);
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_HOOKKEY);
+    stateindex = (uintptr_t)lua_tointeger(s, -2);
+    hookindex = (uintptr_t)lua_tointeger(s, -1);
+    lua_pop(s, 2);
+    
+    // Call back into golang luajit.dohook, raising its errors once it has returned
+    r = dohook(s, ar, stateindex, hookindex);
+    if (r == GOLUAJIT_CALLBACKERROR) {
+        lua_error(s);
+    }
+}
+
+void goluajit_sethook(lua_State *s, uintptr_t hookindex, int mask, int count)
+{
+    // hookindex: the index of our golang Hook in the GovalueRegistry, or 0 when only
+    // watched calls use the hook. A 0 mask removes the hook
+    lua_pushinteger(s, (lua_Integer)hookindex);
+    lua_setfield(s, LUA_REGISTRYINDEX, GOLUAJIT_HOOKKEY);
+    lua_sethook(s, mask == 0 ? NULL : goluajit_hookf, mask, count);
+}
+
+uintptr_t goluajit_gethook(lua_State *s)
+{
+    uintptr_t hookindex;
     
-    // Call back into golang luajit.docallback
-	return docallback(stateindex, funcindex);
+    // return the GovalueRegistry index of the Hook, or 0 if none is set
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_HOOKKEY);
+    hookindex = (uintptr_t)lua_tointeger(s, -1);
+    lua_pop(s, 1);
+    return hookindex;
 }
 
-void goluajit_pushclosure(lua_State *s, int n)
+int goluajit_jitstatus(lua_State *s)
 {
-	// pass a goluajit_closurecallback, +2 upvalues that should have been previously pushed:
-    // 1: the gvindex of our golang State struct
-    // 2: the gvindex of our golang Gofunction func
-    lua_pushcclosure(s, goluajit_closurecallback, n);
-}
\ No newline at end of file
+    int on = 0;
+    
+    // return whether the JIT compiler is on, as reported by jit.status(). The compiler
+    // stays off until the jit library is opened
+    lua_getfield(s, LUA_REGISTRYINDEX, "_LOADED");
+    if (!lua_istable(s, -1)) {
+        lua_pop(s, 1);
+        return 0;
+    }
+    lua_getfield(s, -1, "jit");
+    if (lua_istable(s, -1)) {
+        lua_getfield(s, -1, "status");
+        if (lua_pcall(s, 0, 1, 0) == 0) {
+            on = lua_toboolean(s, -1);
+        }
+        lua_pop(s, 1);
+    }
+    lua_pop(s, 2);
+    return on;
+}
+
+// goluajit_chunkreader is the lua_Reader data of goluajit_load. The golang reader is 
+// held in the GovalueRegistry, chunks are read into buf
+typedef struct {
+    uintptr_t stateindex;
+    uintptr_t readerindex;
+    char buf[LUAL_BUFFERSIZE];
+} goluajit_chunkreader;
+
+static const char *goluajit_readchunk(lua_State *s, void *data, size_t *size)
+{
+    goluajit_chunkreader *reader;
+    
+    // Call back into golang luajit.goreadchunk, a size of 0 ends the chunk
+    reader = (goluajit_chunkreader*)data;
+    *size = goreadchunk(reader->stateindex, reader->readerindex, reader->buf, sizeof(reader->buf));
+    if (*size == 0) {
+        return NULL;
+    }
+    return reader->buf;
+}
+
+int goluajit_load(lua_State *s, uintptr_t stateindex, uintptr_t readerindex, const char *chunkname)
+{
+    goluajit_chunkreader reader;
+    
+    reader.stateindex = stateindex;
+    reader.readerindex = readerindex;
+    return lua_load(s, goluajit_readchunk, &reader, chunkname);
+}
+
+static int goluajit_writechunk(lua_State *s, const void *p, size_t size, void *data)
+{
+    uintptr_t *writerindex;
+    
+    // Call back into golang luajit.gowritechunk, a non zero result aborts the dump
+    writerindex = (uintptr_t*)data;
+    return gowritechunk(writerindex[0], writerindex[1], (void*)p, size);
+}
+
+int goluajit_dump(lua_State *s, uintptr_t stateindex, uintptr_t writerindex)
+{
+    uintptr_t data[2];
+    
+    // data: the gvindex of our golang root State and the index of the golang writer 
+    // in its GovalueRegistry
+    data[0] = stateindex;
+    data[1] = writerindex;
+    return lua_dump(s, goluajit_writechunk, data);
+}
+
+void goluajit_errorinfo(lua_State *s, int level)
+{
+    lua_Debug ar;
+    
+    // replace the error value at the top of the stack with a table holding:
+    // value: the original error value
+    // source, line: the first frame from level up that has a current line
+    // traceback: a traceback from level up
+    lua_createtable(s, 0, 4);
+    lua_pushvalue(s, -2);
+    lua_setfield(s, -2, "value");
+    
+    for (; lua_getstack(s, level, &ar); level++) {
+        lua_getinfo(s, "Sl", &ar);
+        if (ar.currentline > 0) {
+            lua_pushstring(s, ar.short_src);
+            lua_setfield(s, -2, "source");
+            lua_pushinteger(s, ar.currentline);
+            lua_setfield(s, -2, "line");
+            break;
+        }
+    }
+    
+    luaL_traceback(s, s, NULL, level);
+    lua_setfield(s, -2, "traceback");
+    
+    lua_replace(s, -2);
+}
+
+static int goluajit_msghandler(lua_State *s)
+{
+    // level 0 is the handler itself
+    goluajit_errorinfo(s, 1);
+    return 1;
+}
+
+void goluajit_pushmsghandler(lua_State *s)
+{
+    lua_getfield(s, LUA_REGISTRYINDEX, GOLUAJIT_MSGHANDLER);
+}
@@ -2,8 +2,13 @@ package luajit
 
 import(
     "errors"
+    "io"
     "unsafe"
     "fmt"
+    "reflect"
+    "runtime/debug"
+    "sync"
+    "sync/atomic"
 )
 
 /*
@@ -12,10 +17,24 @@ import(
 #include <lauxlib.h>
 #include <lualib.h>
 #include <stddef.h>
+#include <stdint.h>
 #include <stdlib.h>
 
-extern void goluajit_luainit(lua_State*);
-extern void goluajit_pushclosure(lua_State*, int);
+extern void goluajit_luainit(lua_State*, int);
+extern void goluajit_pushclosure(lua_State*, uintptr_t, uintptr_t, int);
+extern void goluajit_pushgcclosure(lua_State*, uintptr_t, uintptr_t);
+extern void goluajit_pushfixedclosure(lua_State*, uintptr_t, uintptr_t);
+extern void goluajit_errorinfo(lua_State*, int);
+extern void goluajit_pushmsghandler(lua_State*);
+extern void goluajit_sethook(lua_State*, uintptr_t, int, int);
+extern uintptr_t goluajit_gethook(lua_State*);
+extern int goluajit_load(lua_State*, uintptr_t, uintptr_t, const char*);
+extern int goluajit_dump(lua_State*, uintptr_t, uintptr_t);
+extern void *goluajit_newallocator(lua_State*);
+extern void goluajit_closeallocator(lua_State*, void*);
+extern void goluajit_setmemorylimit(void*, size_t);
+extern void goluajit_collectgarbage(lua_State*, void*);
+extern void goluajit_memorystats(void*, size_t*, size_t*, size_t*);
 */
 import "C"
 
@@ -23,13 +42,89 @@ import "C"
 type State struct {
     luastate *C.lua_State
     gvindex int
+    gil *Gil
+    
+    // set on the root State only, see Atpanic
+    panichandler Panichandler
+    dead bool
+    
+    // gvregistry holds the go values of the root State and its threads
+    gvregistry *GovalueRegistry
+    
+    // functions holds the Gofunctions pushed by the root State and its threads, indexed
+    // by the handle stored in their closure, and freefunctions the indexes released by 
+    // collected closures. They are only accessed under the Gil.
+    functions []Gofunction
+    freefunctions []int
+    
+    // allocator is the C goluajit_allocator counting the memory of the global state
+    allocator unsafe.Pointer
+    
+    // hookmask and hookcount are the mask and count given to Sethook. The hook lua
+    // calls also counts instructions while executions are watched, see Execution.go
+    hookmask int
+    hookcount int
+    
+    // execution is the innermost watched call of the goroutine holding the Gil, 
+    // watching the number of watched calls in progress on all goroutines, and 
+    // instructionlimit the InstructionLimit of the state. jitwatched is set when the 
+    // JIT compiler was turned off for the watched calls, and interrupting counts the
+    // interrupted calls still running
+    execution *execution
+    watching int
+    instructionlimit int
+    jitwatched bool
+    interrupting int
+    
+    // sandbox is the Sandbox Openlibs applies, nil to open all libraries
+    sandbox *Sandbox
+    
+    // classes are the types registered with RegisterType, only accessed under the Gil
+    classes map[reflect.Type]*class
+    
+    // releasedrefs are the references of the Refs collected by go, released from the
+    // registry by the next Lock or NewRef. refmutex guards them, as go finalizers run
+    // without the Gil
+    releasedrefs []int
+    refmutex *sync.Mutex
+}
+
+// Options configures a State created by NewstateWithOptions
+type Options struct {
+    // MemoryLimit is the maximum number of bytes the state may allocate, 0 for no
+    // limit. Allocations past the limit fail with a LUA_ERRMEM error.
+    MemoryLimit int
+    
+    // InstructionLimit is the maximum number of lua instructions each Pcall and 
+    // PcallContext may run, 0 for no limit. Calls past the limit are interrupted 
+    // with a *LuaError whose Cause is ErrInstructionLimit.
+    InstructionLimit int
+    
+    // Sandbox restricts the libraries Openlibs opens and the modules lua code may 
+    // require, nil for no restrictions.
+    Sandbox *Sandbox
 }
 
+// MemoryStats is a snapshot of the memory held by a global state, in bytes
+type MemoryStats struct {
+    // Current is the memory currently allocated and Peak the most ever allocated
+    Current int
+    Peak int
+    
+    // Limit is the MemoryLimit of the state, 0 if it has none
+    Limit int
+}
+
+// ErrDeadState is returned by Pcall on a State whose global state hit an unprotected
+// error (see Atpanic).
+var ErrDeadState error = errors.New("STATE: state is dead after an unprotected error")
+
 // NewState Creates a new Lua state. It calls luaL_newstate which calls lua_newstate with an allocator based 
 // on the standard C realloc function and then sets a panic function (see lua_atpanic) 
-// that prints an error message to the standard error output in case of fatal errors. 
+// that hands unprotected errors back to go (see Atpanic).
+//
+// The returned State's Gil is held by the calling goroutine. 
 // TODO: Handle NULL return of luaL_newstate and error appropriately
-// TODO: Set panic function for lua_atpanic
 func Newstate() *State {
     state := &State{
         luastate: C.luaL_newstate(),
@@ -38,69 +133,390 @@ func Newstate() *State {
     return state
     
 }
-// geterror attempts to find the lua error type constant and error string
-// from the stack, and generate a go error
+
+// NewstateWithOptions creates a new Lua state like Newstate, configured with options. 
+//
+// With a MemoryLimit, allocations that would take the state past the limit fail: lua
+// raises a LUA_ERRMEM error, returned by Pcall as a *LuaError, after which Pcall runs
+// a full garbage collection so the state may be used again. The limit must leave room
+// for the libraries the host opens, as an error outside any protected call is a panic 
+// (see Atpanic).
+//
+// Luajit cannot raise memory errors from compiled code, so the JIT compiler is turned 
+// off for states with a MemoryLimit. Turning it back on with Setmode makes a memory 
+// error in compiled code an unprotected error.
+func NewstateWithOptions(options Options) (*State, error) {
+    if options.Sandbox != nil {
+        if err := options.Sandbox.validate(); err != nil {
+            return nil, err
+        }
+    }
+    
+    luastate := C.luaL_newstate()
+    if luastate == nil {
+        return nil, errors.New("STATE: unable to create lua_state")
+    }
+    state := &State{
+        luastate: luastate,
+    }
+    state.Init()
+    
+    if options.MemoryLimit > 0 {
+        if state.allocator == nil {
+            state.Close()
+            return nil, errors.New("STATE: unable to create the memory allocator")
+        }
+        if options.MemoryLimit < state.MemoryStats().Current {
+            state.Close()
+            return nil, errors.New("STATE: memory limit is below the memory used by a new state")
+        }
+        C.goluajit_setmemorylimit(state.allocator, C.size_t(options.MemoryLimit))
+        state.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_OFF)
+    }
+    if options.InstructionLimit > 0 {
+        state.instructionlimit = options.InstructionLimit
+    }
+    state.sandbox = options.Sandbox
+    
+    return state, nil
+}
+
+// geterror builds a *LuaError from the lua error code errno and the error value 
+// at the top of the stack. It returns nil if errno is 0.
 func (this *State) geterror(errno int) error {
     if errno == 0 {
         return nil
     }
-        
-    errstr := ""
-        
-    switch errno {
-        case LUA_ERRERR:
-            errstr = LUA_ERRERR_STR
-            break
-        case LUA_ERRSYNTAX:
-            errstr = LUA_ERRSYNTAX_STR
-            break
-        case LUA_ERRRUN:
-            errstr = LUA_ERRRUN_STR
-            break
-        case LUA_ERRMEM:
-            errstr = LUA_ERRMEM_STR
-            break
+    
+    luaerr := &LuaError{Code: errno}
+    
+    if this.Gettop() == 0 {
+        luaerr.Message = "No Error Available On Stack"
+        return luaerr
+    }
+    
+    switch this.Type(-1) {
+        case LUA_TSTRING, LUA_TNUMBER:
+            luaerr.Message = this.Tostring(-1)
         default:
-            errstr = LUA_ERRUNK_STR
+            luaerr.Message = "(error object is a " + this.Typename(-1) + " value)"
     }
+    luaerr.Value = this.tovalue(this.Gettop(), make(map[unsafe.Pointer]map[interface{}]interface{}))
+    luaerr.locate()
     
-    if this.Gettop() == 0 {
-        return errors.New(errstr + "No Error Available On Stack")
-    } else if this.Type(-1) == LUA_TSTRING {
-        return errors.New(errstr + this.Tostring(-1))
-    } else {
-        return errors.New(errstr + "Unable to locate error on stack")
+    return luaerr
+}
+
+// geterrorinfo is geterror for errors whose value was replaced by goluajit_errorinfo. It 
+// collects the location and traceback of the error and restores the original error 
+// value at the top of the stack.
+func (this *State) geterrorinfo(errno int) error {
+    if errno != LUA_ERRRUN || !this.Istable(-1) {
+        return this.geterror(errno)
+    }
+    
+    this.Getfield(-1, "source")
+    source := this.Tostring(-1)
+    this.Getfield(-2, "line")
+    line := this.Tointeger(-1)
+    this.Getfield(-3, "traceback")
+    traceback := this.Tostring(-1)
+    this.Pop(3)
+    
+    this.Getfield(-1, "value")
+    this.Replace(-2)
+    
+    luaerr := this.geterror(errno).(*LuaError)
+    if source != "" {
+        luaerr.Source = source
+        luaerr.Line = line
     }
+    luaerr.Traceback = traceback
+    
+    return luaerr
+}
+
+// tovalue converts the value at the absolute index to a go value for LuaError.Value. 
+// Tables become maps, sharing maps for tables seen more than once.
+func (this *State) tovalue(index int, seen map[unsafe.Pointer]map[interface{}]interface{}) interface{} {
+    switch this.Type(index) {
+        case LUA_TBOOLEAN:
+            return this.Toboolean(index)
+        case LUA_TNUMBER:
+            return this.Tonumber(index)
+        case LUA_TSTRING:
+            return this.Tostring(index)
+        case LUA_TTABLE:
+            ptr := this.Topointer(index)
+            if table, ok := seen[ptr]; ok {
+                return table
+            }
+            
+            table := make(map[interface{}]interface{})
+            seen[ptr] = table
+            
+            if !this.Checkstack(2) {
+                panic("STATE: unable to grow lua_state stack")
+            }
+            this.Pushnil()
+            for this.Next(index) {
+                top := this.Gettop()
+                switch this.Type(top - 1) {
+                    case LUA_TBOOLEAN, LUA_TNUMBER, LUA_TSTRING:
+                        table[this.tovalue(top - 1, seen)] = this.tovalue(top, seen)
+                }
+                this.Pop(1)
+            }
+            return table
+        default:
+            return nil
+    }
+}
+
+// callbackerror is returned by docallback to have the C trampoline raise the error
+// value at the top of the stack. It must match GOLUAJIT_CALLBACKERROR in State.c
+const callbackerror = -2
+
+// errorsignal is the panic value Error uses to unwind a Gofunction back to docallback
+type errorsignal struct{}
+
+func (this errorsignal) Error() string {
+    return "goluajit: State.Error called outside of a Gofunction"
 }
 
 //export docallback
-func docallback(stateindex C.float, funcindex C.float) int {
-    // pull our *State value and Gofunction value from GovalueRegistry
-    stateval, stateerr := Gvregistry.GetValue(int(stateindex)); if stateerr != nil {
-        panic(stateerr.Error())
+func docallback(luastate *C.lua_State, stateindex C.uintptr_t, funcindex C.uintptr_t) (nresults int) {
+    // pull our root *State from rootstates and the Gofunction from its function 
+    // table, neither of which takes a lock. A go panic must not unwind the C 
+    // trampoline, so bad handles are raised as lua errors
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        (&State{luastate: luastate}).Pushstring("goluajit: go function of an unknown state")
+        return callbackerror
     }
-    fnval, fnvalerr := Gvregistry.GetValue(int(funcindex)); if fnvalerr != nil {
-        panic(fnvalerr.Error())
+    state := stateval.(*State)
+    
+    //Call function passing the state of the calling thread, which may be a thread 
+    //created with Newthread rather than the state that pushed the closure
+    callstate := state.wrap(luastate)
+    
+    // Turn Error calls and go panics into lua errors raised by the C trampoline. 
+    defer func() {
+        if r := recover(); r != nil {
+            callstate.pusherror(r)
+            nresults = callbackerror
+        }
+    }()
+    
+    if int(funcindex) >= len(state.functions) || state.functions[funcindex] == nil {
+        callstate.Pushstring(fmt.Sprintf("goluajit: go function %d was released", funcindex))
+        return callbackerror
+    }
+    
+    return state.functions[funcindex](callstate)
+}
+
+// pusherror pushes the lua error for the value r recovered from a Gofunction or 
+// Hook. Error already pushed its error value, any other panic becomes an error 
+// message holding the panic value and the go stack.
+func (this *State) pusherror(r interface{}) {
+    if _, ok := r.(errorsignal); !ok {
+        this.Pushstring(fmt.Sprintf("go panic: %v\n%s", r, debug.Stack()))
+    }
+}
+
+//export dohook
+func dohook(luastate *C.lua_State, ar *C.lua_Debug, stateindex C.uintptr_t, hookindex C.uintptr_t) (status int) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        panic("Invalid State Index Supplied. Index does not exist")
+    }
+    state := stateval.(*State)
+    callstate := state.wrap(luastate)
+    
+    defer func() {
+        if r := recover(); r != nil {
+            callstate.pusherror(r)
+            status = callbackerror
+        }
+    }()
+    
+    // count events also check the watched calls, see Execution.go
+    event := int(ar.event)
+    if event == LUA_HOOKCOUNT && state.watching > 0 {
+        if err := state.interrupted(int(C.lua_gethookcount(luastate))); err != nil {
+            callstate.Pushstring("interrupted: " + err.Error())
+            return callbackerror
+        }
     }
     
-    // Cast to their proper types
-    state, ok := stateval.(*State); if !ok {
-        panic("Error Casting State Interface")
+    // only report the events the Hook asked for
+    if event == LUA_HOOKTAILRET {
+        event = LUA_HOOKRET
     }
-	fn, ok := fnval.(Gofunction); if !ok {
-        panic("Error Casting Gofunction Interface")
+    if hookindex == 0 || state.hookmask & (1 << uint(event)) == 0 {
+        return 0
     }
+    hookval, err := state.gvregistry.GetValue(int(hookindex)); if err != nil {
+        return 0
+    }
+    
+    // copy the fields lua set in the activation record, the others are garbage. The 
+    // private part remains valid for Getinfo and Getlocal while the hook runs
+    hookar := &Debug{}
+    hookar.ar.event = ar.event
+    hookar.ar.currentline = ar.currentline
+    hookar.ar.i_ci = ar.i_ci
+    hookar.update()
     
-    //Call function passing state
-    return fn(state)
+    hookval.(Hook)(callstate, hookar)
+    return 0
+}
+
+// wrap returns a State for the C lua_State luastate, which must belong to the same 
+// global state as this State.
+func (this *State) wrap(luastate *C.lua_State) *State {
+    if luastate == this.luastate {
+        return this
+    }
+    return &State{
+        luastate: luastate,
+        gvindex: this.gvindex,
+        gil: this.gil,
+    }
 }
 
 // Init configures internal values of the luajit.State object. This is called
 // automatically by luajit.Newstate() and should only be called if the State struct
 // was instantiated manually.
 func (this *State) Init() {
-    this.gvindex = Gvregistry.AddValue(this)
-    C.goluajit_luainit(this.luastate)
+    if this.gil == nil {
+        this.gil = NewGil()
+        this.gil.Lock()
+    }
+    this.gvregistry = NewGovalueRegistry()
+    this.refmutex = &sync.Mutex{}
+    this.gvindex = int(atomic.AddInt64(&lastindex, 1))
+    rootstates.Store(this.gvindex, this)
+    C.goluajit_luainit(this.luastate, C.int(this.gvindex))
+    this.allocator = C.goluajit_newallocator(this.luastate)
+}
+
+//export dorelease
+func dorelease(stateindex C.uintptr_t, funcindex C.uintptr_t) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        return
+    }
+    state := stateval.(*State)
+    
+    // a handle is only freed once, and never outside the table
+    if int(funcindex) >= len(state.functions) || state.functions[funcindex] == nil {
+        return
+    }
+    state.functions[funcindex] = nil
+    state.freefunctions = append(state.freefunctions, int(funcindex))
+}
+
+// Returns the GovalueRegistry of this global state. Go values referenced
+// from lua objects of this state, or of its threads, are held there, and 
+// dropped along with the state by Close.
+func (this *State) Registry() *GovalueRegistry {
+    return this.root().gvregistry
+}
+
+// Returns the number of Go functions of this global state that are still
+// referenced from lua. Closures pushed with Pushclosure are released when
+// lua collects them.
+func (this *State) Gofunctioncount() int {
+    root := this.root()
+    return len(root.functions) - len(root.freefunctions)
+}
+
+// Returns the memory held by this global state. Memory is counted from Init on,
+// starting with the memory the state already held. The Gil must be held.
+func (this *State) MemoryStats() MemoryStats {
+    root := this.root()
+    if root.allocator == nil {
+        return MemoryStats{}
+    }
+    
+    var current, peak, limit C.size_t
+    C.goluajit_memorystats(root.allocator, &current, &peak, &limit)
+    return MemoryStats{
+        Current: int(current),
+        Peak: int(peak),
+        Limit: int(limit),
+    }
+}
+
+// Options returns the options this global state was created with, so that states
+// created on its behalf can be restricted the same way. The Gil must be held.
+func (this *State) Options() Options {
+    root := this.root()
+    return Options{
+        MemoryLimit: this.MemoryStats().Limit,
+        InstructionLimit: root.instructionlimit,
+        Sandbox: root.sandbox,
+    }
+}
+
+// reclaim runs a full garbage collection after a LUA_ERRMEM error, so the garbage left 
+// by the failed call does not keep the state at its MemoryLimit
+func (this *State) reclaim(errno int) {
+    root := this.root()
+    if errno == LUA_ERRMEM && root.allocator != nil {
+        C.goluajit_collectgarbage(this.luastate, root.allocator)
+    }
+}
+
+// root returns the State created by Newstate for the global state of this State
+func (this *State) root() *State {
+    rootval, ok := rootstates.Load(this.gvindex); if !ok {
+        panic("Invalid State Index Supplied. Index does not exist")
+    }
+    return rootval.(*State)
+}
+
+// Gil returns the global interpreter lock shared by this State and all threads 
+// of its global state.
+func (this *State) Gil() *Gil {
+    return this.gil
+}
+
+// Lock acquires the Gil of this State. A goroutine must hold the Gil before calling 
+// any other method of the State, for example before running a thread created with 
+// Newthread:
+//
+// 	go func() {
+// 		thread.Lock()
+// 		defer thread.Unlock()
+// 		thread.Call(0, 0)
+// 	}()
+func (this *State) Lock() {
+    this.gil.Lock()
+    
+    // the watched calls of the goroutine that released the Gil do not apply here
+    this.root().execution = nil
+    this.releaserefs()
+}
+
+// Unlock releases the Gil of this State.
+func (this *State) Unlock() {
+    this.gil.Unlock()
+}
+
+// Unlocked releases the Gil, calls fn and reacquires the Gil before returning. Go functions 
+// called from lua must use it around any operation that may block, such as waiting on a
+// channel or a sync.WaitGroup, so other goroutines can run lua code while they wait. fn 
+// must not use the State.
+func (this *State) Unlocked(fn func()) {
+    // restore the watched calls of this goroutine along with the Gil
+    root := this.root()
+    execution := root.execution
+    this.gil.Unlock()
+    defer func() {
+        this.gil.Lock()
+        root.execution = execution
+    }()
+    fn()
 }
 
 // Yields a coroutine.
@@ -197,7 +613,7 @@ func (this *State) Tothread(index int) *State {
 	if t == nil {
 		return nil
 	}
-	return &State{luastate: t}
+	return this.wrap(t)
 }
 
 // Converts the Lua value at the given valid index to a Go
@@ -233,7 +649,18 @@ func (this *State) Tonumber(index int) float64 {
 	return float64(C.lua_tonumber(this.luastate, C.int(index)))
 }
 
-//TODO: lua_tolstring
+// Converts the Lua value at the given index to a byte slice, like Tostring.
+// Unlike Tostring, the bytes are copied up to the length of the lua string,
+// so they may contain embedded zeros. Returns nil if the value is neither a
+// string nor a number.
+func (this *State) Tolstring(index int) []byte {
+    var length C.size_t
+    str := C.lua_tolstring(this.luastate, C.int(index), &length)
+    if str == nil {
+        return nil
+    }
+    return C.GoBytes(unsafe.Pointer(str), C.int(length))
+}
 
 // Converts the Lua value at the given valid index to a Go int. The Lua
 // value must be a number or a string convertible to a number; otherwise,
@@ -296,14 +723,119 @@ func (this *State) Settable(index int) {
 	C.lua_settable(this.luastate, C.int(index))
 }
 
+// Controls the JIT engine of this global state, as luaJIT_setmode does.
+//
+// The mode argument is a LUAJIT_MODE_* mode ORed with the flag LUAJIT_MODE_ON
+// to turn a feature on, LUAJIT_MODE_OFF to turn it off, or LUAJIT_MODE_FLUSH
+// to flush compiled code:
+//
+// 	LUAJIT_MODE_ENGINE       the whole JIT compiler, index is ignored
+// 	LUAJIT_MODE_FUNC         the Lua function at the given stack index
+// 	LUAJIT_MODE_ALLFUNC      the function and all of its sub-functions
+// 	LUAJIT_MODE_ALLSUBFUNC   only the sub-functions of the function
+// 	LUAJIT_MODE_TRACE        flush the compiled trace number index
+//
+// Turning a function off also flushes its compiled code. For example, to 
+// keep the JIT compiler from compiling the global function f:
+//
+// 	s.Getglobal("f")
+// 	err := s.Setmode(-1, luajit.LUAJIT_MODE_FUNC|luajit.LUAJIT_MODE_OFF)
+//
+// Returns an error if the mode failed, for example when the value at index 
+// is not a Lua function or the JIT compiler is not available on this platform.
+func (this *State) Setmode(index int, mode Jitmode) error {
+    if int(C.luaJIT_setmode(this.luastate, C.int(index), C.int(mode))) == 0 {
+        return errors.New("unable to set the JIT mode")
+    }
+    return nil
+}
+
 // Pops a table from the stack and sets it as the new metatable for the
 // value at the given valid index.
 func (this *State) Setmetatable(index int) int {
 	return int(C.lua_setmetatable(this.luastate, C.int(index)))
 }
 
-//TODO: lua_setlocal
-//TODO: lua_sethook
+// Sets the value of a local variable of a given activation record. Parameters
+// ar and n are as in Getlocal. Setlocal assigns the value at the top of the 
+// stack to the variable and returns its name. It also pops the value from 
+// the stack.
+//
+// Returns an error when the index is greater than the number of active local 
+// variables. The value is popped nonetheless.
+func (this *State) Setlocal(ar *Debug, n int) (string, error) {
+    r := C.lua_setlocal(this.luastate, &ar.ar, C.int(n))
+    if r == nil {
+        return "", errors.New("index exceeds number of local variables")
+    }
+    return C.GoString(r), nil
+}
+
+// Sets the debugging hook function.
+//
+// Argument fn is the hook function. mask specifies on which events the hook
+// will be called: it is formed by a bitwise or of the constants LUA_MASKCALL,
+// LUA_MASKRET, LUA_MASKLINE, and LUA_MASKCOUNT. The count argument is only 
+// meaningful when the mask includes LUA_MASKCOUNT. For each event, the hook 
+// is called as explained below:
+//
+// The call hook: is called when the interpreter calls a function. The hook
+// is called just after Lua enters the new function, before the function gets
+// its arguments.
+//
+// The return hook: is called when the interpreter returns from a function. 
+// The hook is called just before Lua leaves the function. You have no access
+// to the values to be returned by the function.
+//
+// The line hook: is called when the interpreter is about to start the 
+// execution of a new line of code, or when it jumps back in the code (even 
+// to the same line). (This event only happens while Lua is executing a Lua 
+// function.)
+//
+// The count hook: is called after the interpreter executes every count 
+// instructions. (This event only happens while Lua is executing a Lua 
+// function.)
+//
+// A hook is disabled by setting mask to 0 or fn to nil. Luajit keeps a single
+// hook per global state, so the hook is shared by this State and all of its 
+// threads, and code compiled by the JIT compiler runs without calling it.
+//
+// The hook is held in the Registry until it is replaced or the state is closed.
+// A count hook also sets how often PcallContext and the InstructionLimit check 
+// whether to interrupt the running call.
+func (this *State) Sethook(fn Hook, mask, count int) {
+    root := this.root()
+    registry := root.gvregistry
+    if old := int(C.goluajit_gethook(this.luastate)); old != 0 {
+        registry.RemoveValue(old)
+    }
+    
+    hookindex := 0
+    if fn == nil || mask == 0 {
+        mask, count = 0, 0
+    } else {
+        hookindex = registry.AddValue(fn)
+    }
+    root.hookmask = mask
+    root.hookcount = count
+    this.sethook(hookindex)
+}
+
+// sethook installs the hook lua calls, for the Hook at hookindex in the Registry and 
+// the watched calls
+func (this *State) sethook(hookindex int) {
+    root := this.root()
+    mask, count := root.hookmask, root.hookcount
+    if root.watching > 0 && (mask & LUA_MASKCOUNT == 0 || count <= 0) {
+        mask |= LUA_MASKCOUNT
+        count = interruptcount
+    }
+    if root.interrupting > 0 {
+        mask |= LUA_MASKCOUNT
+        count = 1
+    }
+    C.goluajit_sethook(this.luastate, C.uintptr_t(hookindex), C.int(mask), C.int(count))
+}
 
 // Pops a value from the stack and sets it as the new value of global name.
 func (this *State) Setglobal(name string) {
@@ -321,8 +853,16 @@ func (this *State) Setfield(index int, k string) {
 	C.lua_setfield(this.luastate, C.int(index), ck)
 }
 
-//TODO: lua_setfenv
-//TODO: lua_setallocf
+// Pops a table from the stack and sets it as the new environment for the
+// value at the given index. If the value at the given index is neither a
+// function nor a thread nor a userdata, Setfenv returns an error. The table
+// is popped nonetheless.
+func (this *State) Setfenv(index int) error {
+    if C.lua_setfenv(this.luastate, C.int(index)) == 0 {
+        return errors.New("value is not a function, thread or userdata")
+    }
+    return nil
+}
 
 // Starts and resumes a coroutine in a given thread.
 //
@@ -347,7 +887,11 @@ func (this *State) Resume(narg int) (yield bool, e error) {
 		return true, nil
 	case r == LUA_OK:
 		return false, nil
+	case r == LUA_ERRRUN:
+		C.goluajit_errorinfo(this.luastate, 0)
+		return false, this.geterrorinfo(r)
 	default:
+		this.reclaim(r)
 		return false, this.geterror(r)
 	}
 }
@@ -430,8 +974,21 @@ func (this *State) Pushnumber(n float64) {
 	C.lua_pushnumber(this.luastate, C.lua_Number(n))
 }
 
-//TODO: lua_pushnil
-//TODO: lua_pushlstring
+// Pushes a nil value onto the stack.
+func (this *State) Pushnil() {
+	C.lua_pushnil(this.luastate)
+}
+
+// Pushes the bytes of b onto the stack as a string. Lua makes an internal
+// copy of the bytes, which may contain embedded zeros.
+func (this *State) Pushlstring(b []byte) {
+    if len(b) == 0 {
+        this.Pushstring("")
+        return
+    }
+    C.lua_pushlstring(this.luastate, (*C.char)(unsafe.Pointer(&b[0])), C.size_t(len(b)))
+}
+
 //TODO: lua_pushliteral
 //TODO: lua_pushlightuserdata
 //TODO: lua_pushinteger
@@ -449,15 +1006,51 @@ func (this *State) Pushnumber(n float64) {
 // stack, with the argument n telling how many values should be associated
 // with the function. Pushclosure also pops these values from the stack.
 //
-// The maximum value for n is 254.
+// The maximum value for n is 254, as one upvalue is used internally to find
+// the State and the Go function. The Go function is released when lua 
+// collects the closure.
 func (this *State) Pushclosure(fn Gofunction, n int) {
-    if !this.Checkstack(1) {
+    if !this.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+	C.goluajit_pushclosure(this.luastate, C.uintptr_t(this.gvindex), C.uintptr_t(this.addfunction(fn)), C.int(n))
+}
+
+// pushgcfunction pushes a Go function for use as a __gc metamethod. Unlike a closure
+// pushed with Pushfunction, it stays callable until its object is finalized, and is 
+// released afterwards.
+func (this *State) pushgcfunction(fn Gofunction) {
+    if !this.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    C.goluajit_pushgcclosure(this.luastate, C.uintptr_t(this.gvindex), C.uintptr_t(this.addfunction(fn)))
+}
+
+// pushfixedfunction pushes a Go function that is never released, for use in metatables
+// kept until the state is closed. It stays callable while Close finalizes objects.
+func (this *State) pushfixedfunction(fn Gofunction) {
+    if !this.Checkstack(2) {
         panic("STATE: unable to grow lua_state stack")
     }
+    
+    C.goluajit_pushfixedclosure(this.luastate, C.uintptr_t(this.gvindex), C.uintptr_t(this.addfunction(fn)))
+}
 
-    C.lua_pushnumber(this.luastate, C.lua_Number(C.float(float64(this.gvindex))))
-    C.lua_pushnumber(this.luastate, C.lua_Number(C.float(float64(Gvregistry.AddValue(fn)))))
-	C.goluajit_pushclosure(this.luastate, C.int(n + 2))
+// addfunction stores fn in the function table of the root State and returns its index
+func (this *State) addfunction(fn Gofunction) int {
+    root := this.root()
+    
+    if nfree := len(root.freefunctions); nfree > 0 {
+        funcindex := root.freefunctions[nfree - 1]
+        root.freefunctions = root.freefunctions[:nfree - 1]
+        root.functions[funcindex] = fn
+        return funcindex
+    }
+    
+    root.functions = append(root.functions, fn)
+    return len(root.functions) - 1
 }
 
 // Pushes a Go function onto the stack. This function receives a pointer to
@@ -484,29 +1077,94 @@ func (this *State) Pushmodule(name string, fn Gofunction) {
 // of metatable keys to Gofunctions.
 // 
 // you must still use Setmetatable after this function returns to assign your metatable to some 
-// other table on the stack.
+// other table on the stack. Without a Name, a new metatable is built on every call. The GC 
+// function is then called when the metatable itself is collected, so each object with a GC 
+// function needs its own metatable.
+//
+// With a Name, the metatable is built once, kept in the registry and shared by every object 
+// it is set on, so its Gofunctions must find their object in their first argument. The GC 
+// function is then the __gc of each userdata the metatable is set on, as tables have no __gc 
+// in lua 5.1. Checkudata checks that a userdata has the metatable:
+//
+// 	s.Newuserdata()
+// 	s.Pushmetatable(&luajit.Gometatable{Name: "duration", AddFunction: add})
+// 	s.Setmetatable(-2)
+//
+// Userdata holding a go value are made with NewGouserdata once the named metatable 
+// was pushed.
 func (this *State) Pushmetatable(mt *Gometatable) {
-    this.Newtable()    
+    if !this.Checkstack(4) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    // the functions of a named metatable are never released, so they can still be 
+    // called while Close finalizes its objects
+    pushfunction := this.Pushfunction
+    if mt.Name != "" {
+        if !this.Newmetatable(mt.Name) {
+            return
+        }
+        pushfunction = this.pushfixedfunction
+    } else {
+        this.Newtable()
+    }
     
-    if mt.Index() != nil {
-        this.Pushfunction(mt.Index())
-        this.Setfield(-2, "__index")
+    for _, method := range mt.metamethods() {
+        if method.fn != nil {
+            pushfunction(method.fn)
+            this.Setfield(-2, method.key)
+        }
+    }
+    if len(mt.Methods) > 0 {
+        this.Newtable()
+        for name, fn := range mt.Methods {
+            pushfunction(fn)
+            this.Setfield(-2, name)
+        }
+        if mt.Index() == nil {
+            this.Pushvalue(-1)
+            this.Setfield(-3, "__index")
+        }
+        this.Setfield(-2, "__methods")
     }
-    if mt.Newindex() != nil {
-        this.Pushfunction(mt.Newindex())
-        this.Setfield(-2, "__newindex")
+    if mt.Mode != "" {
+        this.Pushstring(mt.Mode)
+        this.Setfield(-2, "__mode")
     }
-    if mt.Tostring() != nil {
-        this.Pushfunction(mt.Tostring())
-        this.Setfield(-2, "__tostring")
+    if mt.Metatable != "" {
+        this.Pushstring(mt.Metatable)
+        this.Setfield(-2, "__metatable")
     }
-    if mt.GC() != nil {
-        this.Pushfunction(mt.GC())
+    
+    if mt.GC() != nil && mt.Name != "" {
+        // release the go value of userdata made by NewGouserdata after the GC function
+        gc := mt.GC()
+        pushfunction(func(ls *State) int {
+            defer ls.releasegouserdata(1)
+            return gc(ls)
+        })
         this.Setfield(-2, "__gc")
+    } else if mt.GC() != nil {
+        // Tables have no __gc in lua 5.1, so the metatable anchors a userdata whose
+        // __gc calls the GC function once the metatable is collected, along with 
+        // the object it was set on.
+        this.Newuserdata()
+        this.Newtable()
+        this.pushgcfunction(mt.GC())
+        this.Setfield(-2, "__gc")
+        this.Setmetatable(-2)
+        this.Setfield(-2, "__gcproxy")
     }
 }
 
-//TODO: lua_pushboolean
+// Pushes a boolean value with value b onto the stack.
+func (this *State) Pushboolean(b bool) {
+	if b {
+		C.lua_pushboolean(this.luastate, 1)
+	} else {
+		C.lua_pushboolean(this.luastate, 0)
+	}
+}
 
 // Pops n elements from the stack.
 func (this *State) Pop(index int) {
@@ -532,19 +1190,78 @@ func (this *State) Pop(index int) {
 // information to the error message, such as a stack traceback. Such
 // information cannot be gathered after the return of Pcall, since by then
 // the stack has unwound.
+//
+// The returned error is a *LuaError. If errfunc is 0, Pcall installs its own 
+// error handler, so the LuaError also holds the location of the error and a 
+// traceback, while the original error value is still left on the stack.
+//
+// With an InstructionLimit, the call is interrupted once it runs out of 
+// instructions, see PcallContext.
 func (this *State) Pcall(nargs, nresults, errfunc int) error {
-    defer func() {
-        if r := recover(); r != nil {
-            fmt.Println(r.(string))
-        }
-    }()
-        
-    r := int(C.lua_pcall(this.luastate, C.int(nargs), C.int(nresults), C.int(errfunc)))        
-    return this.geterror(r)
+    if this.Dead() {
+        return ErrDeadState
+    }
+    
+    return this.watch(nil, func() error {
+        return this.pcall(nargs, nresults, errfunc)
+    })
+}
+
+// pcall is Pcall without the dead state check and the InstructionLimit
+func (this *State) pcall(nargs, nresults, errfunc int) error {
+    if errfunc != 0 {
+        r := int(C.lua_pcall(this.luastate, C.int(nargs), C.int(nresults), C.int(errfunc)))        
+        this.reclaim(r)
+        return this.geterror(r)
+    }
+    
+    // Insert our message handler below the function
+    if !this.Checkstack(1) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    base := this.Gettop() - nargs
+    C.goluajit_pushmsghandler(this.luastate)
+    this.Insert(base)
+    
+    r := int(C.lua_pcall(this.luastate, C.int(nargs), C.int(nresults), C.int(base)))
+    this.reclaim(r)
+    err := this.geterrorinfo(r)
+    this.Remove(base)
+    
+    return err
+}
+
+// Returns the "length" of the value at the given index: for strings, this
+// is the string length; for tables, this is the result of the length
+// operator ('#'); for userdata, this is the size of the block of memory
+// allocated for the userdata; for other values, it is 0.
+func (this *State) Objlen(index int) int {
+    return int(C.lua_objlen(this.luastate, C.int(index)))
 }
 
-//TODO: lua_objlen
-//TODO: lua_next
+// Pops a key from the stack, and pushes a key-value pair from the table at
+// the given index (the "next" pair after the given key). If there are no
+// more elements in the table, then Next returns false (and pushes nothing).
+//
+// A typical traversal looks like this:
+//
+// 	// table is in the stack at index t
+// 	s.Pushnil() // first key
+// 	for s.Next(t) {
+// 		// uses 'key' (at index -2) and 'value' (at index -1)
+// 		fmt.Printf("%s - %s\n",
+// 			s.Typename(-2),
+// 			s.Typename(-1))
+// 		// removes 'value'; keeps 'key' for next iteration
+// 		s.Pop(1)
+// 	}
+//
+// While traversing a table, do not call Tostring directly on a key, unless
+// you know that the key is actually a string. Recall that Tostring changes
+// the value at the given index; this confuses the next call to Next.
+func (this *State) Next(index int) bool {
+	return int(C.lua_next(this.luastate, C.int(index))) != 0
+}
 
 // Newuserdata.  This function allocates a new block of memory with the given size, 
 // pushes onto the stack a new full userdata with the block address, and returns this 
@@ -567,6 +1284,9 @@ func (this *State) Newuserdata() {
 //
 // There is no explicit function to close or to destroy a thread. Threads
 // are subject to garbage collection, like any Lua object.
+//
+// The new thread shares the Gil of this State. A goroutine running the thread 
+// must hold the Gil (see Lock).
 func (this *State) Newthread() *State {
     if !this.Checkstack(1) {
         panic("STATE: unable to grow lua_state stack")
@@ -574,6 +1294,8 @@ func (this *State) Newthread() *State {
     
     newstate := &State{
         luastate: C.lua_newthread(this.luastate),
+        gvindex: this.gvindex,
+        gil: this.gil,
     }
     
 	return newstate
@@ -586,7 +1308,86 @@ func (this *State) Newtable() {
 }
 
 //TODO: lua_newstate
-//TODO: lua_load
+
+// maxemptyreads is the number of reads returning nothing after which Load gives up
+// with io.ErrNoProgress, as bufio does
+const maxemptyreads = 100
+
+// chunkreader is the go side of the lua_Reader used by Load. It is held in the 
+// Registry while lua reads the chunk, and records the first read error.
+type chunkreader struct {
+    reader io.Reader
+    err error
+}
+
+//export goreadchunk
+func goreadchunk(stateindex C.uintptr_t, readerindex C.uintptr_t, buf *C.char, size C.size_t) (n C.size_t) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        return 0
+    }
+    chunkval, err := stateval.(*State).gvregistry.GetValue(int(readerindex)); if err != nil {
+        return 0
+    }
+    chunk := chunkval.(*chunkreader)
+    if chunk.err != nil {
+        return 0
+    }
+    
+    // a panicking reader ends the chunk like a failing one, it must not unwind lua_load
+    defer func() {
+        if r := recover(); r != nil {
+            chunk.err = fmt.Errorf("go panic: %v", r)
+            n = 0
+        }
+    }()
+    
+    // read straight into the C buffer, retrying reads that return nothing a few times,
+    // as the Gil is held
+    b := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))
+    for i := 0; i < maxemptyreads; i++ {
+        read, err := chunk.reader.Read(b)
+        if err != nil && err != io.EOF {
+            chunk.err = err
+        }
+        if read > 0 || err != nil {
+            return C.size_t(read)
+        }
+    }
+    chunk.err = io.ErrNoProgress
+    return 0
+}
+
+// Loads a Lua chunk read from reader. If there are no errors, Load pushes the 
+// compiled chunk as a Lua function on top of the stack. Otherwise, it pushes 
+// nothing and returns a *LuaError for a syntax or memory error, or the error 
+// returned by reader. A reader that keeps returning no data and no error fails with
+// io.ErrNoProgress.
+//
+// The chunkname argument gives a name to the chunk, which is used for error 
+// messages and in debug information. A chunkname starting with '@' names a file,
+// one starting with '=' is used as is.
+//
+// Load only loads a chunk; it does not run it. It automatically detects whether
+// the chunk is text or binary, and loads it accordingly (see Dump). The Gil is 
+// held while reading, so reader should not block for long.
+func (this *State) Load(reader io.Reader, chunkname string) error {
+    cs := C.CString(chunkname)
+    defer C.free(unsafe.Pointer(cs))
+    
+    chunk := &chunkreader{reader: reader}
+    registry := this.Registry()
+    readerindex := registry.AddValue(chunk)
+    defer registry.RemoveValue(readerindex)
+    
+    r := int(C.goluajit_load(this.luastate, C.uintptr_t(this.gvindex), C.uintptr_t(readerindex), cs))
+    if chunk.err != nil {
+        // drop whatever lua made of the partial chunk
+        this.Pop(1)
+        return chunk.err
+    }
+    return this.geterror(r)
+}
+
 //TODO: lua_lessthan
 
 // Returns true if the value at the given acceptable index is a userdata
@@ -689,13 +1490,113 @@ func (this *State) Gettable(index int) {
 	C.lua_gettable(this.luastate, C.int(index))
 }
 
-//TODO: lua_getstack
-//TODO: lua_getmetatable
-//TODO: lua_getlocal
-//TODO: lua_getinfo
-//TODO: lua_gethookmask
-//TODO: lua_gethookcount
-//TODO: lua_gethook
+// Gets information about the interpreter runtime stack.
+//
+// This function returns a Debug with its private part filled with an 
+// identification of the activation record of the function executing at a
+// given level. Level 0 is the current running function, whereas level n+1
+// is the function that has called level n. When called with a level greater
+// than the stack depth, it returns an error.
+func (this *State) Getstack(level int) (*Debug, error) {
+    ar := &Debug{}
+    if int(C.lua_getstack(this.luastate, C.int(level), &ar.ar)) == 0 {
+        return nil, errors.New("level exceeds the stack depth")
+    }
+    return ar, nil
+}
+
+// Pushes onto the stack the metatable of the value at the given acceptable
+// index. If the index is not valid, or if the value does not have a 
+// metatable, the function returns false and pushes nothing on the stack.
+func (this *State) Getmetatable(index int) bool {
+    return int(C.lua_getmetatable(this.luastate, C.int(index))) != 0
+}
+
+// Gets information about a local variable of a given activation record. The
+// parameter ar must be a valid activation record that was filled by a
+// previous call to Getstack or given as argument to a hook. The index n 
+// selects which local variable to inspect (1 is the first parameter or
+// active local variable, and so on, until the last active local variable). 
+// Getlocal pushes the variable's value onto the stack and returns its name.
+//
+// Variable names starting with '(' (open parentheses) represent internal
+// variables (loop control variables, temporaries, and Go function locals).
+//
+// If ar is nil, Getlocal returns the name of the n-th parameter of the Lua
+// function at the top of the stack, and pushes nothing.
+//
+// Returns an empty string (and pushes nothing) when the index is greater
+// than the number of active local variables.
+func (this *State) Getlocal(ar *Debug, n int) string {
+    var car *C.lua_Debug
+    if ar != nil {
+        car = &ar.ar
+    }
+    return gostring(C.lua_getlocal(this.luastate, car, C.int(n)))
+}
+
+// Returns information about a specific function or function invocation.
+//
+// To get information about a function invocation, the parameter ar must be
+// a valid activation record that was filled by a previous call to Getstack
+// or given as argument to a hook.
+//
+// To get information about a function you push it onto the stack and start
+// the what string with the character '>'. (In that case, Getinfo pops the
+// function in the top of the stack.) For instance, to know in which line
+// a function f was defined, you can write the following code:
+//
+// 	ar := &luajit.Debug{}
+// 	s.Getglobal("f")  // get global 'f'
+// 	s.Getinfo(">S", ar)
+// 	fmt.Printf("%d\n", ar.Linedefined)
+//
+// Each character in the string what selects some fields of ar to be filled
+// or a value to be pushed on the stack:
+//
+// 	'n'	fills in the field Name and Namewhat
+// 	'S'	fills in the fields Source, Shortsrc, Linedefined,
+// 		Lastlinedefined, and What
+// 	'l'	fills in the field Currentline
+// 	'u'	fills in the field Nups
+// 	'f'	pushes onto the stack the function that is running at the
+// 		given level
+// 	'L'	pushes onto the stack a table whose indices are the numbers of
+// 		the lines that are valid on the function.
+//
+// Returns an error on an invalid option in what.
+func (this *State) Getinfo(what string, ar *Debug) error {
+    cs := C.CString(what)
+    defer C.free(unsafe.Pointer(cs))
+    
+    if int(C.lua_getinfo(this.luastate, cs, &ar.ar)) == 0 {
+        return errors.New("invalid option in what")
+    }
+    ar.update()
+    return nil
+}
+
+// Returns the current hook mask.
+func (this *State) Gethookmask() int {
+    return this.root().hookmask
+}
+
+// Returns the current hook count.
+func (this *State) Gethookcount() int {
+    return this.root().hookcount
+}
+
+// Returns the current hook function, or nil if none is set.
+func (this *State) Gethook() Hook {
+    hookindex := int(C.goluajit_gethook(this.luastate))
+    if hookindex == 0 {
+        return nil
+    }
+    hookval, err := this.Registry().GetValue(hookindex); if err != nil {
+        return nil
+    }
+    return hookval.(Hook)
+}
 
 // Pushes onto the stack the value of the global name.
 func (this *State) Getglobal(name string) {
@@ -710,24 +1611,85 @@ func (this *State) Getfield(index int, k string) {
 	C.lua_getfield(this.luastate, C.int(index), cs)
 }
 
-//TODO: lua_getfenv
+// Pushes onto the stack the environment table of the value at the given
+// index.
+func (this *State) Getfenv(index int) {
+    C.lua_getfenv(this.luastate, C.int(index))
+}
+
 //TODO: lua_getallocf
 //TODO: lua_gc
 
 // Generates a Lua error. The error message (which can actually be a Lua
-// value of any type) must be on the stack top. This function does a long
-// jump, and therefore never returns.
+// value of any type) must be on the stack top. This function never returns.
+//
+// Error may only be called from a Gofunction called by lua. It unwinds the 
+// Gofunction with a go panic, and the error is raised once control is back
+// in C, so lua never long jumps over go frames. For the same reason, any other
+// panic in a Gofunction is raised as a lua error holding the panic value and
+// the go stack, which lua code can catch with pcall.
 func (this *State) Error() {
-    C.lua_error(this.luastate)
-    
-    /*err := this.Tostring(-1)    
-    fmt.Println("ERROR: ", err)
-    this.Dostring(`print(debug.traceback())`)    
-    panic("goluajit Panic")*/
+    panic(errorsignal{})
 }
 
 //TODO: lua_equal
-//TODO: lua_dump
+
+// chunkwriter is the go side of the lua_Writer used by Dump. It is held in the
+// Registry while lua writes the chunk, and records the write error.
+type chunkwriter struct {
+    writer io.Writer
+    err error
+}
+
+//export gowritechunk
+func gowritechunk(stateindex C.uintptr_t, writerindex C.uintptr_t, p unsafe.Pointer, size C.size_t) (status C.int) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        return 1
+    }
+    chunkval, err := stateval.(*State).gvregistry.GetValue(int(writerindex)); if err != nil {
+        return 1
+    }
+    chunk := chunkval.(*chunkwriter)
+    
+    defer func() {
+        if r := recover(); r != nil {
+            chunk.err = fmt.Errorf("go panic: %v", r)
+            status = 1
+        }
+    }()
+    
+    if _, err := chunk.writer.Write(unsafe.Slice((*byte)(p), int(size))); err != nil {
+        chunk.err = err
+        return 1
+    }
+    return 0
+}
+
+// Dumps a function as a binary chunk. Receives a Lua function on the top of 
+// the stack and produces a binary chunk that, if loaded again, results in a
+// function equivalent to the one dumped. As it produces parts of the chunk,
+// Dump writes them to writer.
+//
+// Returns the error returned by writer, or an error if the value on the top 
+// of the stack is not a Lua function. Binary chunks are only portable across
+// LuaJIT builds of the same version and architecture.
+//
+// This function does not pop the Lua function from the stack.
+func (this *State) Dump(writer io.Writer) error {
+    chunk := &chunkwriter{writer: writer}
+    registry := this.Registry()
+    writerindex := registry.AddValue(chunk)
+    defer registry.RemoveValue(writerindex)
+    
+    r := int(C.goluajit_dump(this.luastate, C.uintptr_t(this.gvindex), C.uintptr_t(writerindex)))
+    if chunk.err != nil {
+        return chunk.err
+    }
+    if r != 0 {
+        return errors.New("unable to dump a value that is not a lua function")
+    }
+    return nil
+}
 
 // Creates a new empty table and pushes it onto the stack. The new table
 // has space pre-allocated for narr array elements and nrec non-array
@@ -758,8 +1720,21 @@ func (this *State) Concat(n int) {
 // host program ends. On the other hand, long-running programs, such as
 // a daemon or a web server, might need to release states as soon as they
 // are not needed, to avoid growing too large.
+//
+// Close also drops the Registry and Go functions of the state. It must be
+// called on the State returned by Newstate, not on one of its threads, and 
+// neither the State nor its threads may be used afterwards.
 func (this *State) Close() {
+    if this.allocator != nil {
+        C.goluajit_closeallocator(this.luastate, this.allocator)
+        this.allocator = nil
+    }
 	C.lua_close(this.luastate)
+    
+    this.gvregistry.clear()
+    this.functions = nil
+    this.freefunctions = nil
+    rootstates.Delete(this.gvindex)
 }
 
 // Ensures that there are at least extra free stack slots in the stack. It
@@ -792,23 +1767,96 @@ func (this *State) Call(nargs, nresults int) {
 	C.lua_call(this.luastate, C.int(nargs), C.int(nresults))
 }
 
-//TODO: lua_atpanic. NOTE: not sure if this is possible to pass back to golang. 
-// use pcall instead on first script run and pass an index of a function on the stack.
+// Sets handler as the panic handler of the global state of this State.
+//
+// If an error happens outside any protected environment, for example in
+// Call, lua calls the panic handler with a *LuaPanic holding the error, 
+// its traceback and the State it happened in. The global state is then 
+// marked dead (see Dead), and after the handler returns, the error unwinds
+// the go code that entered lua with a go panic whose value is the same 
+// *LuaPanic. The host may recover it and discard the state, or let it 
+// crash the process. A handler may also write a crash report and exit.
+func (this *State) Atpanic(handler Panichandler) {
+    this.root().panichandler = handler
+}
+
+// Returns true if the global state of this State hit an unprotected error.
+// A dead state must not be used anymore, except to Close it.
+func (this *State) Dead() bool {
+    return this.root().dead
+}
+
+//export dopanic
+func dopanic(luastate *C.lua_State, stateindex C.int) {
+    stateval, ok := rootstates.Load(int(stateindex)); if !ok {
+        panic("Invalid State Index Supplied. Index does not exist")
+    }
+    state := stateval.(*State)
+    
+    // the state is dead, lift its MemoryLimit so the error can be reported
+    if state.allocator != nil {
+        C.goluajit_setmemorylimit(state.allocator, 0)
+    }
+    
+    callstate := state.wrap(luastate)
+    C.goluajit_errorinfo(luastate, 0)
+    luapanic := &LuaPanic{
+        State: callstate,
+        Err: callstate.geterrorinfo(LUA_ERRRUN).(*LuaError),
+    }
+    
+    state.dead = true
+    if state.panichandler != nil {
+        state.panichandler(luapanic)
+    }
+    
+    panic(luapanic)
+}
 
-//TODO: lua_Writer
 //TODO: lua_State
-//TODO: lua_Reader
 //TODO: lua_Number
 //TODO: lua_Integer
-//TODO: lua_Hook
-//TODO: lua_Debug
 //TODO: lua_CFunction
-//TODO: lua_Alloc
 //TODO: luaL_where
-//TODO: luaL_unref
-//TODO: luaL_typerror
+
+// Releases reference ref from the table at index t (see Ref). The entry is
+// removed from the table, so that the referred object can be collected. The
+// reference ref is also freed to be used again.
+//
+// If ref is LUA_NOREF or LUA_REFNIL, Unref does nothing.
+func (this *State) Unref(t, ref int) {
+    C.luaL_unref(this.luastate, C.int(t), C.int(ref))
+}
+
+// Generates an error with a message like the following:
+// 	bad argument #narg to 'func' (tname expected, got rt)
+// where rt is the type name of the actual argument. This function never 
+// returns.
+func (this *State) Typeerror(narg int, tname string) {
+    got := this.Typename(narg)
+    if this.Isnone(narg) {
+        got = "no value"
+    }
+    this.Argerror(narg, tname + " expected, got " + got)
+}
+
 //TODO: luaL_register
-//TODO: luaL_ref
+
+// Creates and returns a reference, in the table at index t, for the object at
+// the top of the stack (and pops the object).
+//
+// A reference is a unique integer key. As long as you do not manually add 
+// integer keys into table t, Ref ensures the uniqueness of the key it returns.
+// You can retrieve an object referred by reference r by calling 
+// s.Rawgeti(t, r). Function Unref frees a reference and its associated object.
+//
+// If the object at the top of the stack is nil, Ref returns the constant 
+// LUA_REFNIL. The constant LUA_NOREF is guaranteed to be different from any 
+// reference returned by Ref. See also NewRef.
+func (this *State) Ref(t int) int {
+    return int(C.luaL_ref(this.luastate, C.int(t)))
+}
+
 //TODO: luaL_pushresult
 //TODO: luaL_prepbuffer
 //TODO: luaL_optstring
@@ -820,11 +1868,35 @@ func (this *State) Call(nargs, nresults int) {
 
 // Openlibs Opens all standard Lua libraries into the given state. 
 // http://www.lua.org/manual/5.1/manual.html#luaL_openlibs
+//
+// Opening the jit library turns the JIT compiler on, except for states with
+// a MemoryLimit (see NewstateWithOptions).
+//
+// States with a Sandbox only open the libraries of the sandbox, and restrict 
+// them as it says. Modules pushed with Pushmodule need the package library.
 func (this *State) Openlibs() {
-    C.luaL_openlibs(this.luastate)
+    if sandbox := this.root().sandbox; sandbox != nil {
+        sandbox.open(this)
+    } else {
+        C.luaL_openlibs(this.luastate)
+    }
+    if this.MemoryStats().Limit > 0 {
+        this.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_OFF)
+    }
 }
 
-//TODO: luaL_newmetatable
+// If the registry already has the key tname, returns false. Otherwise, 
+// creates a new table to be used as a metatable for userdata, adds it to 
+// the registry with key tname, and returns true.
+//
+// In both cases pushes onto the stack the final value associated with tname
+// in the registry.
+func (this *State) Newmetatable(tname string) bool {
+    cs := C.CString(tname)
+    defer C.free(unsafe.Pointer(cs))
+    
+    return int(C.luaL_newmetatable(this.luastate, cs)) != 0
+}
 
 // Loads a string as a Lua chunk.
 //
@@ -852,7 +1924,25 @@ func (this *State) Loadfile(filename string) error {
     return this.geterror(int(C.luaL_loadfile(this.luastate, cs)))
 }
 
-//TODO: luaL_loadbuffer
+// Loads a buffer as a Lua chunk. This function uses lua_load to load the chunk
+// in buf. Unlike Loadstring, buf may hold embedded zeros, so it may be a binary
+// chunk produced by Dump.
+//
+// The name argument gives the chunk name, as in Load.
+//
+// This function only loads the chunk; it does not run it. 
+func (this *State) Loadbuffer(buf []byte, name string) error {
+    cs := C.CString(name)
+    defer C.free(unsafe.Pointer(cs))
+    
+    // lua only reads buf during the call, so it is passed to C without a copy
+    var cbuf *C.char
+    if len(buf) > 0 {
+        cbuf = (*C.char)(unsafe.Pointer(&buf[0]))
+    }
+    return this.geterror(int(C.luaL_loadbuffer(this.luastate, cbuf, C.size_t(len(buf)), cs)))
+}
+
 //TODO: luaL_gsub
 //TODO: luaL_getmetatable
 //TODO: luaL_getmetafield
@@ -888,7 +1978,27 @@ func (this *State) Dofile(path string) int {
     return 0
 }
 
-//TODO: luaL_checkudata
+// Checks whether the function argument narg is a userdata of the type tname
+// (see Newmetatable) and returns its block address, raising an argument error
+// otherwise.
+func (this *State) Checkudata(narg int, tname string) unsafe.Pointer {
+    if !this.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    p := this.Touserdata(narg)
+    if p != nil && this.Type(narg) == LUA_TUSERDATA && this.Getmetatable(narg) {
+        this.Getfield(LUA_REGISTRYINDEX, tname)
+        same := this.Rawequal(-1, -2)
+        this.Pop(2)
+        if same {
+            return p
+        }
+    }
+    this.Typeerror(narg, tname)
+    return nil
+}
+
 //TODO: luaL_checktype
 //TODO: luaL_checkstring
 //TODO: luaL_checkstack
@@ -901,7 +2011,29 @@ func (this *State) Dofile(path string) int {
 //TODO: luaL_checkany
 //TODO: luaL_callmeta
 //TODO: luaL_buffinit
-//TODO: luaL_argerror
+
+// Raises an error with the following message, where func is retrieved from
+// the call stack:
+// 	bad argument #narg to 'func' (extramsg)
+// This function never returns.
+func (this *State) Argerror(narg int, extramsg string) {
+    name := "?"
+    if ar, err := this.Getstack(0); err == nil && this.Getinfo("n", ar) == nil {
+        if ar.Namewhat == "method" {
+            narg--
+            if narg == 0 {
+                this.Pushstring("calling '" + ar.Name + "' on bad self (" + extramsg + ")")
+                this.Error()
+            }
+        }
+        if ar.Name != "" {
+            name = ar.Name
+        }
+    }
+    this.Pushstring(fmt.Sprintf("bad argument #%d to '%s' (%s)", narg, name, extramsg))
+    this.Error()
+}
+
 //TODO: luaL_argcheck
 //TODO: luaL_addvalue
 //TODO: luaL_addstring
@@ -0,0 +1,1546 @@
+package luajit
+
+import(
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "runtime"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "testing/iotest"
+    "time"
+    "unsafe"
+)
+
+func TestGil(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    // only one goroutine at a time runs lua code or Go functions called from it, and a
+    // Go function waiting with the Gil released lets the other goroutines run
+    var running, overlaps int32
+    s.Pushfunction(func(ls *State) int {
+        if atomic.AddInt32(&running, 1) != 1 {
+            atomic.AddInt32(&overlaps, 1)
+        }
+        atomic.AddInt32(&running, -1)
+        
+        ls.Unlocked(func() {
+            time.Sleep(100 * time.Microsecond)
+        })
+        return 0
+    })
+    s.Setglobal("block")
+    if err := s.Loadstring(`
+        count = 0
+        function work()
+            for i = 1, 100 do
+                local t = {tostring(i)}
+                count = count + #t
+                block()
+            end
+        end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    const goroutines = 8
+    threads := make([]*State, goroutines)
+    for i := range threads {
+        threads[i] = s.Newthread()
+    }
+    
+    // the threads stay on the stack of s, which the test goroutine no longer uses
+    // once it released the Gil
+    errs := make(chan error, goroutines)
+    s.Unlock()
+    for _, thread := range threads {
+        go func(thread *State) {
+            thread.Lock()
+            defer thread.Unlock()
+            thread.Getglobal("work")
+            errs <- thread.Pcall(0, 0, 0)
+        }(thread)
+    }
+    for range threads {
+        if err := <- errs; err != nil {
+            t.Error(err)
+        }
+    }
+    s.Lock()
+    
+    s.Getglobal("count")
+    if count := s.Tonumber(-1); count != goroutines * 100 || overlaps != 0 {
+        t.Errorf("expected a count of %d without overlaps, got %v with %d overlaps", goroutines * 100, count, overlaps)
+    }
+    s.Pop(1)
+}
+
+func TestGofunctionErrors(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    s.Pushfunction(func(ls *State) int {
+        panic("boom")
+    })
+    s.Setglobal("panics")
+    s.Pushfunction(func(ls *State) int {
+        panic(errors.New("bad value"))
+    })
+    s.Setglobal("panicswitherror")
+    s.Pushfunction(Errorfunction(func(ls *State) (int, error) {
+        return 0, errors.New("no such key")
+    }))
+    s.Setglobal("fails")
+    
+    // go panics and returned errors become lua errors pcall catches, holding the 
+    // go stack of the failed call
+    cases := [][3]string{
+        {`return select(2, pcall(panics))`, "go panic: boom\n", "State_test.go"},
+        {`return select(2, pcall(panicswitherror))`, "go panic: bad value\n", "State_test.go"},
+        {`return select(2, pcall(fails))`, "no such key\n", "Errorfunction"},
+    }
+    for _, c := range cases {
+        if err := s.Loadstring(c[0]); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 1, 0); err != nil {
+            t.Fatal(err)
+        }
+        result := s.Tostring(-1)
+        if !strings.HasPrefix(result, c[1]) || !strings.Contains(result, "goroutine ") || !strings.Contains(result, c[2]) {
+            t.Errorf("expected %q and a go stack through %s from %s, got %q", c[1], c[2], c[0], result)
+        }
+        s.Pop(1)
+    }
+    
+    // an uncaught panic fails Pcall without unwinding the go caller
+    if err := s.Loadstring(`panics()`); err != nil {
+        t.Fatal(err)
+    }
+    err := s.Pcall(0, 0, 0)
+    if luaerr, ok := err.(*LuaError); !ok || !strings.HasPrefix(luaerr.Message, "go panic: boom") {
+        t.Errorf("expected the go panic from Pcall, got %v", err)
+    }
+    s.Pop(1)
+}
+
+func TestAtpanic(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    var handled *LuaPanic
+    s.Atpanic(func(luapanic *LuaPanic) {
+        handled = luapanic
+    })
+    
+    // an error outside any protected call reaches the handler, then unwinds the go
+    // caller with a go panic
+    if err := s.Loadstring(`error("unprotected")`); err != nil {
+        t.Fatal(err)
+    }
+    recovered := func() (r interface{}) {
+        defer func() {
+            r = recover()
+        }()
+        s.Call(0, 0)
+        return nil
+    }()
+    
+    luapanic, ok := recovered.(*LuaPanic)
+    if !ok || luapanic != handled {
+        t.Fatalf("expected the *LuaPanic given to the handler, got %v", recovered)
+    }
+    if luapanic.State == nil || luapanic.Err.Message != `[string "error("unprotected")"]:1: unprotected` || luapanic.Err.Line != 1 {
+        t.Errorf("expected the error and its location, got %+v", luapanic.Err)
+    }
+    if !strings.HasPrefix(luapanic.Err.Traceback, "stack traceback:") {
+        t.Errorf("expected a traceback, got %q", luapanic.Err.Traceback)
+    }
+    
+    // the dead state refuses further calls
+    if !s.Dead() {
+        t.Fatal("expected the state to be dead")
+    }
+    if err := s.Loadstring(`return 1`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != ErrDeadState {
+        t.Errorf("expected ErrDeadState from Pcall, got %v", err)
+    }
+    if err := s.PcallContext(context.Background(), 0, 1); err != ErrDeadState {
+        t.Errorf("expected ErrDeadState from PcallContext, got %v", err)
+    }
+    
+    // other states live on
+    other := Newstate()
+    defer other.Close()
+    if other.Dead() {
+        t.Error("expected a new state not to be dead")
+    }
+}
+
+func TestPushfunction(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    calls := 0
+    s.Pushfunction(func(ls *State) int {
+        calls++
+        ls.Pushnumber(ls.Tonumber(1) * 2)
+        return 1
+    })
+    s.Setglobal("double")
+    
+    if err := s.Loadstring(`result = double(21)`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    s.Getglobal("result")
+    if calls != 1 || s.Tonumber(-1) != 42 {
+        t.Errorf("expected 1 call returning 42, got %d calls returning %v", calls, s.Tonumber(-1))
+    }
+}
+
+// BenchmarkCallback measures the cost of calling a Go function from lua
+func BenchmarkCallback(b *testing.B) {
+    s := Newstate()
+    defer s.Close()
+    
+    s.Pushfunction(func(ls *State) int {
+        return 0
+    })
+    s.Setglobal("noop")
+    
+    if err := s.Loadstring(`local n = ...; for i = 1, n do noop() end`); err != nil {
+        b.Fatal(err)
+    }
+    
+    b.ResetTimer()
+    s.Pushnumber(float64(b.N))
+    if err := s.Pcall(1, 0, 0); err != nil {
+        b.Fatal(err)
+    }
+}
+
+// BenchmarkPushfunction measures the cost of registering a Go function with lua
+func BenchmarkPushfunction(b *testing.B) {
+    s := Newstate()
+    defer s.Close()
+    
+    fn := func(ls *State) int {
+        return 0
+    }
+    
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        s.Pushfunction(fn)
+        s.Pop(1)
+    }
+}
+
+func TestGofunctionsAreCollected(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    fn := func(ls *State) int {
+        return 0
+    }
+    before := s.Gofunctioncount()
+    
+    for i := 0; i < 10000; i++ {
+        s.Pushfunction(fn)
+        s.Pop(1)
+    }
+    if err := s.Loadstring(`collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    if after := s.Gofunctioncount(); after != before {
+        t.Errorf("expected %d live go functions after collection, got %d", before, after)
+    }
+}
+
+// TestFunctionHandlesAboveFloat32 pushes Go functions with handles past 2^24, where 
+// handles stored as float32 would collide, and checks each call reaches its own 
+// function and released handles are reused.
+func TestFunctionHandlesAboveFloat32(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    // skip the handles below the boundary rather than pushing 2^24 closures
+    const boundary = 1 << 24
+    s.functions = make([]Gofunction, boundary, boundary + 4)
+    
+    for i := 0; i < 3; i++ {
+        i := i
+        s.Pushfunction(func(ls *State) int {
+            ls.Pushnumber(float64(i))
+            return 1
+        })
+        s.Setglobal("handle" + string(rune('a' + i)))
+    }
+    if n := len(s.functions); n != boundary + 3 {
+        t.Fatalf("expected %d function handles, got %d", boundary + 3, n)
+    }
+    
+    if err := s.Loadstring(`return handlea() .. handleb() .. handlec()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if result := s.Tostring(-1); result != "012" {
+        t.Errorf("expected each handle to call its own function, got %q", result)
+    }
+    s.Pop(1)
+    
+    // release the middle handle and check it is handed out again
+    if err := s.Loadstring(`handleb = nil; collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if len(s.freefunctions) != 1 || s.freefunctions[0] != boundary + 1 {
+        t.Fatalf("expected handle %d to be released, got %v", boundary + 1, s.freefunctions)
+    }
+    
+    s.Pushfunction(func(ls *State) int {
+        ls.Pushstring("reused")
+        return 1
+    })
+    s.Setglobal("handleb")
+    if err := s.Loadstring(`return handlea() .. handleb() .. handlec()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if result := s.Tostring(-1); result != "0reused2" || len(s.functions) != boundary + 3 {
+        t.Errorf("expected the released handle to be reused, got %q with %d handles", result, len(s.functions))
+    }
+}
+
+func TestReleasedFunctionHandles(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    fn := func(ls *State) int {
+        return 0
+    }
+    s.Pushfunction(fn)
+    s.Setglobal("released")
+    s.Pushfunction(fn)
+    s.Setglobal("outside")
+    
+    // a handle whose function was released, or past the end of the table, raises a 
+    // lua error instead of a go panic
+    s.functions[len(s.functions) - 2] = nil
+    s.functions = s.functions[:len(s.functions) - 1]
+    chunks := [][2]string{
+        {`return tostring(pcall(released))`, "false"},
+        {`return select(2, pcall(released))`, fmt.Sprintf("goluajit: go function %d was released", len(s.functions) - 1)},
+        {`return select(2, pcall(outside))`, fmt.Sprintf("goluajit: go function %d was released", len(s.functions))},
+    }
+    runchunks(t, s, chunks)
+}
+
+func TestGCFunctionOfTables(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    index := s.Registry().AddValue("object")
+    stats := s.Registry().Stats()
+    
+    s.Newtable()
+    s.Pushmetatable(&Gometatable{
+        GCFunction: func(ls *State) int {
+            s.Registry().RemoveValue(index)
+            return 0
+        },
+    })
+    s.Setmetatable(-2)
+    s.Pop(1)
+    
+    if err := s.Loadstring(`collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    if s.Registry().Len() != stats.Len - 1 || s.Registry().Stats().Removed != stats.Removed + 1 {
+        t.Errorf("expected the table GC function to remove its value, stats before %+v after %+v", stats, s.Registry().Stats())
+    }
+}
+
+func TestRegistryIsPerState(t *testing.T) {
+    s1 := Newstate()
+    s2 := Newstate()
+    defer s2.Close()
+    
+    index := s1.Registry().AddValue("s1 value")
+    if _, err := s2.Registry().GetValue(index); err == nil {
+        t.Error("expected looking up a value of another state to fail")
+    }
+    if value, err := s1.Registry().GetValue(index); err != nil || value != "s1 value" {
+        t.Errorf("expected s1 value, got %v, %v", value, err)
+    }
+    
+    registry := s1.Registry()
+    s1.Close()
+    if registry.Len() != 0 {
+        t.Errorf("expected Close to drop the registry, %d values left", registry.Len())
+    }
+}
+
+func TestSethook(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    // record the lines run by the chunk, and the value of local x at line 3
+    lines := []int{}
+    seen := 0.0
+    s.Sethook(func(ls *State, ar *Debug) {
+        lines = append(lines, ar.Currentline)
+        if ar.Currentline == 3 {
+            ls.Getlocal(ar, 1)
+            seen = ls.Tonumber(-1)
+            ls.Pop(1)
+        }
+    }, LUA_MASKLINE, 0)
+    
+    if err := s.Loadstring("local x = 1\nx = x + 1\nresult = x"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    if len(lines) != 3 || seen != 2 {
+        t.Errorf("expected lines 1 to 3 with x = 2 at line 3, got %v with x = %v", lines, seen)
+    }
+    
+    s.Sethook(nil, 0, 0)
+    if s.Gethook() != nil || s.Gethookmask() != 0 || s.Registry().Len() != 0 {
+        t.Errorf("expected the hook to be removed from the state and its Registry")
+    }
+}
+
+func TestHookError(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    s.Sethook(func(ls *State, ar *Debug) {
+        ls.Pushstring("hook error")
+        ls.Error()
+    }, LUA_MASKCOUNT, 10)
+    
+    if err := s.Loadstring(`while true do end`); err != nil {
+        t.Fatal(err)
+    }
+    err := s.Pcall(0, 0, 0)
+    if luaerr, ok := err.(*LuaError); !ok || luaerr.Message != "hook error" {
+        t.Errorf("expected the hook error, got %v", err)
+    }
+}
+
+func TestGetinfo(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    var ar *Debug
+    s.Pushfunction(func(ls *State) int {
+        ar, _ = ls.Getstack(1)
+        ls.Getinfo("nSl", ar)
+        return 0
+    })
+    s.Setglobal("where")
+    
+    if err := s.Loadstring("local function f()\n where()\nend\nf()"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    if ar == nil || ar.Name != "f" || ar.What != "Lua" || ar.Currentline != 2 || ar.Linedefined != 1 {
+        t.Errorf("expected local f defined at line 1 running line 2, got %+v", ar)
+    }
+}
+
+func TestDumpAndLoad(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    if err := s.Load(strings.NewReader("return ...  * 2"), "=double"); err != nil {
+        t.Fatal(err)
+    }
+    buf := &bytes.Buffer{}
+    if err := s.Dump(buf); err != nil {
+        t.Fatal(err)
+    }
+    s.Pop(1)
+    
+    // the bytecode holds zeros, so only Loadbuffer may load it
+    if !bytes.Contains(buf.Bytes(), []byte{0}) {
+        t.Fatal("expected a binary chunk")
+    }
+    if err := s.Loadbuffer(buf.Bytes(), "=double"); err != nil {
+        t.Fatal(err)
+    }
+    s.Pushnumber(21)
+    if err := s.Pcall(1, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if s.Tonumber(-1) != 42 {
+        t.Errorf("expected 42, got %v", s.Tonumber(-1))
+    }
+    
+    s.Pushnumber(1)
+    if err := s.Dump(buf); err == nil {
+        t.Error("expected dumping a number to fail")
+    }
+}
+
+func TestLoadReaderError(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    readerr := errors.New("connection reset")
+    reader := io.MultiReader(strings.NewReader("x = 1\n"), iotest.ErrReader(readerr))
+    if err := s.Load(reader, "=remote"); err != readerr {
+        t.Errorf("expected the reader error, got %v", err)
+    }
+    if s.Gettop() != 0 || s.Registry().Len() != 0 {
+        t.Errorf("expected Load to leave nothing behind, top %d registry %d", s.Gettop(), s.Registry().Len())
+    }
+    
+    // a reader that never returns data nor an error must not hang Load
+    if err := s.Load(emptyreader{}, "=empty"); err != io.ErrNoProgress {
+        t.Errorf("expected io.ErrNoProgress, got %v", err)
+    }
+}
+
+// emptyreader is an io.Reader that reads nothing forever
+type emptyreader struct{}
+
+func (this emptyreader) Read(p []byte) (int, error) {
+    return 0, nil
+}
+
+func TestSetmode(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    if err := s.Loadstring(`local n = 0; for i = 1, 1000 do n = n + i end; return n`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Setmode(-1, LUAJIT_MODE_FUNC|LUAJIT_MODE_OFF); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil || s.Tonumber(-1) != 500500 {
+        t.Fatalf("expected 500500 from the interpreter, got %v, %v", s.Tonumber(-1), err)
+    }
+    
+    if err := s.Setmode(-1, LUAJIT_MODE_FUNC|LUAJIT_MODE_OFF); err == nil {
+        t.Error("expected setting the mode of a number to fail")
+    }
+    if err := s.Setmode(0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_FLUSH); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestMemoryLimit(t *testing.T) {
+    s, err := NewstateWithOptions(Options{MemoryLimit: 1 << 20})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    s.Openlibs()
+    
+    // each chunk fails, and the state remains usable as Pcall collects its garbage
+    chunks := []string{
+        `local t = {}; for i = 1, 1e7 do t[i] = i end`,
+        `local t = {}; for i = 1, 1e7 do t[i] = tostring(i) end`,
+        `local t = {}; for i = 1, 1e7 do t["k"..i] = {} end`,
+        `local s = string.rep("x", 2 ^ 21)`,
+    }
+    for _, chunk := range chunks {
+        if err := s.Loadstring(chunk); err != nil {
+            t.Fatal(err)
+        }
+        err = s.Pcall(0, 0, 0)
+        if luaerr, ok := err.(*LuaError); !ok || luaerr.Code != LUA_ERRMEM {
+            t.Fatalf("expected a LUA_ERRMEM error from %s, got %v", chunk, err)
+        }
+        s.Pop(1)
+        
+        stats := s.MemoryStats()
+        if stats.Peak > stats.Limit || stats.Current > stats.Limit / 2 {
+            t.Errorf("expected usage within the limit after %s, got %+v", chunk, stats)
+        }
+    }
+    
+    if err := s.Loadstring(`return 1 + 1`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil || s.Tonumber(-1) != 2 {
+        t.Errorf("expected 2, got %v, %v", s.Tonumber(-1), err)
+    }
+    
+    if _, err := NewstateWithOptions(Options{MemoryLimit: 1}); err == nil {
+        t.Error("expected a limit below the memory of a new state to fail")
+    }
+}
+
+func TestLuaError(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    cases := []struct {
+        chunk string
+        code int
+        message string
+        value interface{}
+        source string
+        line int
+        traceback bool
+    }{
+        {`error("boom")`, LUA_ERRRUN, `[string "error("boom")"]:1: boom`, `[string "error("boom")"]:1: boom`, `[string "error("boom")"]`, 1, true},
+        {"\nlocal t = nil\nreturn t.x", LUA_ERRRUN, `[string "..."]:3: attempt to index local 't' (a nil value)`, `[string "..."]:3: attempt to index local 't' (a nil value)`, `[string "..."]`, 3, true},
+        {`error({code = 42})`, LUA_ERRRUN, "(error object is a table value)", map[interface{}]interface{}{"code": float64(42)}, `[string "error({code = 42})"]`, 1, true},
+        {`error("plain", 0)`, LUA_ERRRUN, "plain", "plain", `[string "error("plain", 0)"]`, 1, true},
+        {`error()`, LUA_ERRRUN, "(error object is a nil value)", nil, `[string "error()"]`, 1, true},
+        {`x = `, LUA_ERRSYNTAX, `[string "x = "]:1: unexpected symbol near '<eof>'`, `[string "x = "]:1: unexpected symbol near '<eof>'`, `[string "x = "]`, 1, false},
+    }
+    for _, c := range cases {
+        err := s.Loadstring(c.chunk)
+        if err == nil {
+            err = s.Pcall(0, 0, 0)
+        }
+        luaerr, ok := err.(*LuaError)
+        if !ok {
+            t.Fatalf("expected a *LuaError from %q, got %v", c.chunk, err)
+        }
+        if luaerr.Code != c.code || luaerr.Message != c.message || !reflect.DeepEqual(luaerr.Value, c.value) {
+            t.Errorf("expected code %d, message %q and value %#v from %q, got %d, %q and %#v", c.code, c.message, c.value, c.chunk, luaerr.Code, luaerr.Message, luaerr.Value)
+        }
+        if luaerr.Source != c.source || luaerr.Line != c.line {
+            t.Errorf("expected the error from %q at %s:%d, got %s:%d", c.chunk, c.source, c.line, luaerr.Source, luaerr.Line)
+        }
+        if hastraceback := strings.HasPrefix(luaerr.Traceback, "stack traceback:"); hastraceback != c.traceback {
+            t.Errorf("expected a traceback from %q: %v, got %q", c.chunk, c.traceback, luaerr.Traceback)
+        }
+        s.Settop(0)
+    }
+}
+
+func TestLuaErrorLocate(t *testing.T) {
+    cases := []struct {
+        err LuaError
+        source string
+        line int
+    }{
+        {LuaError{Message: `[string "x = 1"]:3: boom`}, `[string "x = 1"]`, 3},
+        {LuaError{Message: `main.lua:12: attempt to call a nil value`}, "main.lua", 12},
+        {LuaError{Message: `C:\app\main.lua:7: boom`}, `C:\app\main.lua`, 7},
+        {LuaError{Message: `boom`}, "", 0},
+        {LuaError{Message: `main.lua:x: boom`}, "", 0},
+        {LuaError{Message: `main.lua:12: boom`, Source: "known.lua", Line: 2}, "known.lua", 2},
+    }
+    for _, c := range cases {
+        c.err.locate()
+        if c.err.Source != c.source || c.err.Line != c.line {
+            t.Errorf("expected %q to be located at %s:%d, got %s:%d", c.err.Message, c.source, c.line, c.err.Source, c.err.Line)
+        }
+    }
+}
+
+func TestPcallContext(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    // compile the loop first, compiled code must not escape the context
+    if err := s.Loadstring(`
+        function spin(n)
+            local i = 0
+            while n == nil or i < n do i = i + 1 end
+        end
+        spin(1e6)
+    `); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    chunks := []string{
+        `spin()`,
+        `while true do pcall(spin) end`,
+    }
+    for _, chunk := range chunks {
+        ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+        if err := s.Loadstring(chunk); err != nil {
+            t.Fatal(err)
+        }
+        err := s.PcallContext(ctx, 0, 0)
+        cancel()
+        if luaerr, ok := err.(*LuaError); !ok || !errors.Is(err, context.DeadlineExceeded) {
+            t.Fatalf("expected %s to be interrupted, got %v", chunk, err)
+        } else if !strings.Contains(luaerr.Message, "interrupted") {
+            t.Errorf("expected an interrupted message, got %q", luaerr.Message)
+        }
+        s.Pop(1)
+    }
+    
+    if err := s.Loadstring(`return 1 + 1`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.PcallContext(context.Background(), 0, 1); err != nil || s.Tonumber(-1) != 2 {
+        t.Errorf("expected 2, got %v, %v", s.Tonumber(-1), err)
+    }
+    if s.Context() != context.Background() {
+        t.Error("expected the background context outside of PcallContext")
+    }
+}
+
+func TestInstructionLimit(t *testing.T) {
+    s, err := NewstateWithOptions(Options{InstructionLimit: 100000})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    
+    // a count hook set by the host still sees its own events
+    lines := 0
+    s.Sethook(func(ls *State, ar *Debug) {
+        lines++
+    }, LUA_MASKLINE, 0)
+    
+    if err := s.Loadstring(`local n = 0; for i = 1, 1000 do n = n + i end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if lines == 0 || s.Gethookmask() != LUA_MASKLINE {
+        t.Errorf("expected line events and a LUA_MASKLINE mask, got %d and %d", lines, s.Gethookmask())
+    }
+    
+    if err := s.Loadstring(`while true do end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); !errors.Is(err, ErrInstructionLimit) {
+        t.Errorf("expected the instruction limit to be exceeded, got %v", err)
+    }
+}
+
+func TestSandbox(t *testing.T) {
+    s, err := NewstateWithOptions(Options{Sandbox: &Sandbox{
+        Libs: []string{"base", "package", "string", "os"},
+        Modules: []string{"mod"},
+        Deny: []string{"os.execute", "dofile"},
+    }})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    s.Openlibs()
+    
+    module := func(ls *State) int {
+        ls.Newtable()
+        ls.Pushnumber(1)
+        ls.Setfield(-2, "x")
+        return 1
+    }
+    s.Pushmodule("mod", module)
+    s.Pushmodule("other", module)
+    
+    chunks := []string{
+        `assert(os.execute == nil and os.time ~= nil and dofile == nil)`,
+        `assert(io == nil and debug == nil and jit == nil and package.loadlib == nil)`,
+        `assert(require("mod").x == 1)`,
+        `assert(not pcall(require, "other") and not pcall(require, "ffi"))`,
+        `local f, err = loadstring(string.dump(function() end)); assert(f == nil and err:find("binary"))`,
+        `local i = 0
+         local f = load(function() i = i + 1; return ({"return ", "42"})[i] end)
+         assert(f() == 42)`,
+    }
+    for _, chunk := range chunks {
+        if err := s.Loadstring(chunk); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 0, 0); err != nil {
+            t.Errorf("%s: %v", chunk, err)
+        }
+    }
+    
+    // globals set by a chunk stay in its environment
+    if err := s.Loadstring(`x = string.rep("a", 2)`); err != nil {
+        t.Fatal(err)
+    }
+    s.Newenv()
+    s.Pushvalue(-1)
+    s.Insert(-3)
+    if err := s.Setfenv(-2); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    s.Getfield(-1, "x")
+    s.Getglobal("x")
+    if s.Tostring(-2) != "aa" || !s.Isnil(-1) {
+        t.Errorf("expected x in the environment only, got %q and %q", s.Tostring(-2), s.Tostring(-1))
+    }
+    
+    // hosts load code from sandboxed code without bytecode
+    if err := s.Loadstring(`return string.dump(function() end)`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    bytecode := s.Tostring(-1)
+    s.Pop(1)
+    if err := s.Loadsource(bytecode); err == nil || !strings.Contains(err.Error(), "binary chunk") {
+        t.Errorf("expected Loadsource to refuse bytecode, got %v", err)
+    }
+    if err := s.Loadsource(`return 1`); err != nil {
+        t.Error(err)
+    }
+    s.Pop(1)
+    
+    if _, err := NewstateWithOptions(Options{Sandbox: &Sandbox{Libs: []string{"sys"}}}); err == nil {
+        t.Error("expected an unknown library to fail")
+    }
+}
+
+type marshalbase struct {
+    Id int `lua:"id"`
+}
+
+type marshalrecord struct {
+    marshalbase
+    Name string `lua:"name"`
+    Tags []string `lua:"tags"`
+    Scores map[string]float64 `lua:"scores"`
+    Data []byte `lua:"data"`
+    Next *marshalrecord `lua:"next"`
+    Skipped int `lua:"-"`
+}
+
+func TestPushAndToValue(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    record := &marshalrecord{
+        marshalbase: marshalbase{Id: 7},
+        Name: "first",
+        Tags: []string{"a", "b"},
+        Scores: map[string]float64{"x": 1.5},
+        Data: []byte("a\x00b"),
+        Next: &marshalrecord{Name: "second"},
+        Skipped: 3,
+    }
+    if err := s.Push(record); err != nil {
+        t.Fatal(err)
+    }
+    s.Setglobal("record")
+    
+    if err := s.Loadstring(`
+        assert(record.id == 7 and record.name == "first" and record.Skipped == nil)
+        assert(#record.tags == 2 and record.tags[2] == "b" and record.scores.x == 1.5)
+        assert(record.data == "a\0b" and record.next.name == "second" and record.next.next == nil)
+    `); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    s.Getglobal("record")
+    decoded := &marshalrecord{}
+    if err := s.ToValue(-1, decoded); err != nil {
+        t.Fatal(err)
+    }
+    record.Skipped = 0
+    if !reflect.DeepEqual(record, decoded) {
+        t.Errorf("expected %+v, got %+v", record, decoded)
+    }
+    s.Pop(1)
+    
+    var generic interface{}
+    if err := s.Loadstring(`return {1, "two", {three = true}}`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.ToValue(-1, &generic); err != nil {
+        t.Fatal(err)
+    }
+    expected := []interface{}{1.0, "two", map[interface{}]interface{}{"three": true}}
+    if !reflect.DeepEqual(generic, expected) {
+        t.Errorf("expected %v, got %v", expected, generic)
+    }
+    s.Pop(1)
+}
+
+func TestToValueErrors(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    
+    chunks := map[string]string{
+        `return {name = 1}`: "cannot convert lua number to go value of type string at .name",
+        `return {id = 1.5}`: "number 1.5 does not fit in go value of type int at .id",
+        `return {tags = {"a", false}}`: "cannot convert lua boolean to go value of type string at .tags[2]",
+        `local t = {}; t.next = t; return t`: "cyclic table at .next",
+    }
+    for chunk, message := range chunks {
+        if err := s.Loadstring(chunk); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 1, 0); err != nil {
+            t.Fatal(err)
+        }
+        err := s.ToValue(-1, &marshalrecord{})
+        if err == nil || !strings.Contains(err.Error(), message) {
+            t.Errorf("expected %q from %s, got %v", message, chunk, err)
+        }
+        s.Pop(1)
+    }
+    
+    cyclic := &marshalrecord{}
+    cyclic.Next = cyclic
+    if err := s.Push(cyclic); err == nil || s.Gettop() != 0 {
+        t.Errorf("expected a cyclic value to fail and push nothing, got %v", err)
+    }
+    if err := s.Push(make(chan int)); err == nil {
+        t.Error("expected a channel to fail")
+    }
+}
+
+func TestRegisterFunc(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    funcs := map[string]interface{}{
+        "repeatstring": strings.Repeat,
+        "sum": func(values ...float64) float64 {
+            total := 0.0
+            for _, value := range values {
+                total += value
+            }
+            return total
+        },
+        "greet": func(name string, greeting *string) string {
+            if greeting == nil {
+                return "hello " + name
+            }
+            return *greeting + " " + name
+        },
+        "divide": func(a, b int) (int, error) {
+            if b == 0 {
+                return 0, errors.New("division by zero")
+            }
+            return a / b, nil
+        },
+        "top": func(ls *State, values ...interface{}) int {
+            return ls.Gettop()
+        },
+    }
+    for name, fn := range funcs {
+        if err := s.RegisterFunc(name, fn); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := s.RegisterFuncWithOptions("check", func(ok bool) error {
+        if !ok {
+            return errors.New("check failed")
+        }
+        return nil
+    }, FuncOptions{RaiseErrors: true}); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.RegisterFunc("notafunc", 1); err == nil {
+        t.Error("expected registering a non function to fail")
+    }
+    
+    chunks := [][2]string{
+        {`return repeatstring("ab", 3)`, "ababab"},
+        {`return tostring(sum(1, 2, 3.5))`, "6.5"},
+        {`return greet("lua")`, "hello lua"},
+        {`return greet("lua", "hi")`, "hi lua"},
+        {`return tostring(divide(7, 2))`, "3"},
+        {`return select(2, divide(1, 0))`, "division by zero"},
+        {`return tostring(top(1, 2, 3))`, "3"},
+        {`return tostring(check(true))`, "true"},
+        {`return select(2, pcall(check, false))`, "check failed"},
+        {`return select(2, pcall(repeatstring, "ab", "x"))`, "bad argument #2 to '?' (number expected, got string)"},
+        {`return select(2, pcall(function() local s = repeatstring("ab", "x"); return s end))`, "bad argument #2 to 'repeatstring' (number expected, got string)"},
+        {`return select(2, pcall(function() local n = divide(1.5, 1); return n end))`, "bad argument #1 to 'divide' (number 1.5 does not fit in go value of type int)"},
+        {`return select(2, pcall(function() local s = greet(); return s end))`, "bad argument #1 to 'greet' (string expected, got no value)"},
+    }
+    runchunks(t, s, chunks)
+}
+
+type objectcounter struct {
+    Name string
+    Count int
+    Next *objectcounter
+}
+
+func (this *objectcounter) Add(n int) int {
+    this.Count += n
+    return this.Count
+}
+
+func (this *objectcounter) String() string {
+    return "counter " + this.Name
+}
+
+func TestPushObject(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    counter := &objectcounter{Name: "a"}
+    if err := s.PushObject(counter); err != nil {
+        t.Fatal(err)
+    }
+    s.Setglobal("counter")
+    if err := s.RegisterFunc("same", func(a, b *objectcounter) bool {
+        return a == b
+    }); err != nil {
+        t.Fatal(err)
+    }
+    
+    chunks := [][2]string{
+        {`counter:add(2); return tostring(counter:Add(1))`, "3"},
+        {`counter.Name = "b"; return tostring(counter)`, "counter b"},
+        {`return tostring(counter.Count)`, "3"},
+        {`return tostring(counter.Next)`, "nil"},
+        {`return tostring(same(counter, counter))`, "true"},
+        {`return select(2, pcall(function() counter.Count = "x" end))`, "cannot set field 'Count' of *luajit.objectcounter (cannot convert lua string to go value of type int)"},
+        {`return select(2, pcall(function() counter.missing = 1 end))`, "cannot set field 'missing' of *luajit.objectcounter"},
+        {`return select(2, pcall(function() local n = counter.add(1); return n end))`, "bad argument #1 to 'add' (*luajit.objectcounter expected, got number, call methods with ':')"},
+        {`return getmetatable(counter)`, "*luajit.objectcounter"},
+        {`return tostring(pcall(function() getmetatable(counter).__methods.add = nil end))`, "false"},
+        {`return select(2, pcall(function() local n = counter:add("x"); return n end))`, "bad argument #1 to 'add' (number expected, got string)"},
+    }
+    runchunks(t, s, chunks)
+    if counter.Name != "b" || counter.Count != 3 {
+        t.Errorf("expected the go object to be updated, got %+v", counter)
+    }
+    
+    // registered pointers are pushed as objects and converted back
+    counter.Next = &objectcounter{Name: "c"}
+    s.Getglobal("counter")
+    s.Getfield(-1, "Next")
+    var next *objectcounter
+    if err := s.ToValue(-1, &next); err != nil || next != counter.Next {
+        t.Errorf("expected the next counter back, got %v, %v", next, err)
+    }
+    s.Pop(2)
+    
+    // collected objects release their go value
+    collect := func() {
+        if err := s.Loadstring(`collectgarbage()`); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 0, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+    collect()
+    before := s.Registry().Len()
+    for i := 0; i < 1000; i++ {
+        if err := s.PushObject(&objectcounter{}); err != nil {
+            t.Fatal(err)
+        }
+        s.Pop(1)
+    }
+    collect()
+    if after := s.Registry().Len(); after != before {
+        t.Errorf("expected %d go values after collection, got %d", before, after)
+    }
+    
+    if err := s.PushObject(objectcounter{}); err == nil {
+        t.Error("expected pushing a struct value to fail")
+    }
+    if err := s.RegisterType(reflect.TypeOf(0)); err == nil {
+        t.Error("expected registering an int type to fail")
+    }
+}
+
+func TestNamedGometatable(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    // durations are userdata, their value is kept by block address
+    durations := map[unsafe.Pointer]time.Duration{}
+    collected := 0
+    var pushduration func(ls *State, d time.Duration)
+    check := func(ls *State, narg int) time.Duration {
+        return durations[ls.Checkudata(narg, "duration")]
+    }
+    binary := func(op func(a, b time.Duration) time.Duration) Gofunction {
+        return func(ls *State) int {
+            pushduration(ls, op(check(ls, 1), check(ls, 2)))
+            return 1
+        }
+    }
+    compare := func(op func(a, b time.Duration) bool) Gofunction {
+        return func(ls *State) int {
+            ls.Pushboolean(op(check(ls, 1), check(ls, 2)))
+            return 1
+        }
+    }
+    pushduration = func(ls *State, d time.Duration) {
+        ls.Newuserdata()
+        durations[ls.Touserdata(-1)] = d
+        ls.Pushmetatable(&Gometatable{
+            Name: "duration",
+            Metatable: "locked",
+            TostringFunction: func(ls *State) int {
+                ls.Pushstring(check(ls, 1).String())
+                return 1
+            },
+            GCFunction: func(ls *State) int {
+                delete(durations, ls.Touserdata(1))
+                collected++
+                return 0
+            },
+            AddFunction: binary(func(a, b time.Duration) time.Duration { return a + b }),
+            SubFunction: binary(func(a, b time.Duration) time.Duration { return a - b }),
+            UnmFunction: func(ls *State) int {
+                pushduration(ls, -check(ls, 1))
+                return 1
+            },
+            EqFunction: compare(func(a, b time.Duration) bool { return a == b }),
+            LtFunction: compare(func(a, b time.Duration) bool { return a < b }),
+            LeFunction: compare(func(a, b time.Duration) bool { return a <= b }),
+            LenFunction: func(ls *State) int {
+                ls.Pushnumber(check(ls, 1).Seconds())
+                return 1
+            },
+            ConcatFunction: func(ls *State) int {
+                ls.Pushstring(ls.Tostring(1) + check(ls, 2).String())
+                return 1
+            },
+            CallFunction: func(ls *State) int {
+                pushduration(ls, check(ls, 1) * time.Duration(ls.Tointeger(2)))
+                return 1
+            },
+        })
+        ls.Setmetatable(-2)
+    }
+    s.Register(func(ls *State) int {
+        pushduration(ls, time.Duration(ls.Tonumber(1) * float64(time.Second)))
+        return 1
+    }, "seconds")
+    
+    chunks := [][2]string{
+        {`return tostring(seconds(1) + seconds(2))`, "3s"},
+        {`return tostring(seconds(5) - seconds(2))`, "3s"},
+        {`return tostring(-seconds(2))`, "-2s"},
+        {`return tostring(seconds(2) == seconds(2))`, "true"},
+        {`return tostring(seconds(1) < seconds(2))`, "true"},
+        {`return tostring(seconds(3) <= seconds(2))`, "false"},
+        {`return tostring(#seconds(90))`, "90"},
+        {`return "took " .. seconds(2)`, "took 2s"},
+        {`return tostring(seconds(2)(3))`, "6s"},
+        {`return getmetatable(seconds(1))`, "locked"},
+        {`return select(2, pcall(setmetatable, seconds(1), {}))`, "bad argument #1 to '?' (table expected, got userdata)"},
+    }
+    runchunks(t, s, chunks)
+    
+    // the metatable is built once and its GC function called for every userdata
+    functions := s.Gofunctioncount()
+    if err := s.Loadstring(`for i = 1, 100 do local d = seconds(i) end; collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if after := s.Gofunctioncount(); after != functions {
+        t.Errorf("expected %d go functions, got %d", functions, after)
+    }
+    if len(durations) != 0 || collected == 0 {
+        t.Errorf("expected every duration to be collected, %d left", len(durations))
+    }
+    
+    s.Newtable()
+    s.Pushmetatable(&Gometatable{Mode: "k"})
+    s.Setmetatable(-2)
+    s.Setglobal("weak")
+    // kept is finalized by Close
+    if err := s.Loadstring(`kept = seconds(1); weak[{}] = true; collectgarbage(); return next(weak)`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if !s.Isnil(-1) {
+        t.Error("expected the weak table to be emptied")
+    }
+    s.Pop(1)
+}
+
+func TestGouserdata(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    gced := 0
+    s.Pushmetatable(&Gometatable{
+        Name: "box",
+        Methods: map[string]Gofunction{
+            "get": func(ls *State) int {
+                ls.Pushstring(*ls.CheckGouserdata(1, "box").(*string))
+                return 1
+            },
+        },
+        GCFunction: func(ls *State) int {
+            if _, ok := ls.Togouserdata(1, "box"); ok {
+                gced++
+            }
+            return 0
+        },
+    })
+    s.Pop(1)
+    
+    value := "boxed"
+    s.NewGouserdata(&value, "box")
+    s.Setglobal("box")
+    other := 1
+    s.NewGouserdata(&other, "other")
+    s.Setglobal("other")
+    
+    chunks := [][2]string{
+        {`return box:get()`, "boxed"},
+        {`debug.setmetatable(other, debug.getmetatable(box)); return select(2, pcall(function() local v = other:get(); return v end))`, "calling 'get' on bad self (box expected, got userdata)"},
+        {`return select(2, pcall(function() local v = box.get({}); return v end))`, "bad argument #1 to 'get' (box expected, got table)"},
+        {`return select(2, pcall(function() box.get = nil end))`, `[string "return select(2, pcall(function() box.get = n..."]:1: attempt to index global 'box' (a userdata value)`},
+    }
+    runchunks(t, s, chunks)
+    
+    s.Newuserdata()
+    if _, ok := s.Togouserdata(-1, "box"); ok {
+        t.Error("expected a plain userdata not to be a box")
+    }
+    s.Pop(1)
+    
+    // other userdata given the metatables, such as the upvalue of a go function, do
+    // not release go values when collected, even when the upvalue holds the registry 
+    // index of one
+    plain := "plain"
+    s.NewGouserdata(&plain, "plain")
+    s.Setglobal("plain")
+    for index, v := range s.Registry().registry {
+        if ud, ok := v.(*gouserdata); ok && ud.value == &plain && index > len(s.functions) {
+            s.functions = append(s.functions, make([]Gofunction, index - len(s.functions))...)
+        }
+    }
+    for _, name := range []string{"plainfunction", "boxfunction"} {
+        s.Pushfunction(func(ls *State) int {
+            return 0
+        })
+        s.Setglobal(name)
+    }
+    values := s.Registry().Len()
+    if err := s.Loadstring(`
+        debug.setmetatable(select(2, debug.getupvalue(plainfunction, 1)), debug.getmetatable(plain))
+        debug.setmetatable(select(2, debug.getupvalue(boxfunction, 1)), debug.getmetatable(box))
+        plainfunction, boxfunction = nil, nil
+        collectgarbage()
+        collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if gced != 0 || s.Registry().Len() != values {
+        t.Errorf("expected no value to be released, gc calls %d, values %d -> %d", gced, values, s.Registry().Len())
+    }
+    
+    // the value is released once the GC function has run
+    before := s.Registry().Len()
+    if err := s.Loadstring(`box = nil; collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if gced != 1 || s.Registry().Len() != before - 1 {
+        t.Errorf("expected the box to be collected and released, gc calls %d, values %d -> %d", gced, before, s.Registry().Len())
+    }
+}
+
+func TestRef(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    if err := s.Loadstring(`local n = 0; return function() n = n + 1; return n end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    counter := s.NewRef(-1)
+    s.Pop(1)
+    if err := s.Loadstring(`collectgarbage()`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    
+    for i := 1; i <= 2; i++ {
+        counter.Push()
+        if err := s.Pcall(0, 1, 0); err != nil {
+            t.Fatal(err)
+        }
+        if n := s.Tointeger(-1); n != i {
+            t.Errorf("expected the referenced function to return %d, got %d", i, n)
+        }
+        s.Pop(1)
+    }
+    
+    counter.Release()
+    counter.Release()
+    counter.Push()
+    if !counter.Released() || !s.Isnil(-1) {
+        t.Errorf("expected a released ref to push nil, got %s", s.Typename(-1))
+    }
+    s.Pop(1)
+    
+    // refs collected by go are released by the next Lock
+    if err := s.Loadstring(`weak = setmetatable({}, {__mode = "v"}); for i = 1, 10 do weak[i] = {} end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    s.Getglobal("weak")
+    for i := 1; i <= 10; i++ {
+        s.Rawgeti(-1, i)
+        s.NewRef(-1)
+        s.Pop(1)
+    }
+    s.Pop(1)
+    
+    remaining := 10
+    for deadline := time.Now().Add(5 * time.Second); remaining > 0 && time.Now().Before(deadline); {
+        runtime.GC()
+        time.Sleep(10 * time.Millisecond)
+        s.Unlock()
+        s.Lock()
+        if err := s.Loadstring(`collectgarbage(); local n = 0; for _ in pairs(weak) do n = n + 1 end; return n`); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 1, 0); err != nil {
+            t.Fatal(err)
+        }
+        remaining = s.Tointeger(-1)
+        s.Pop(1)
+    }
+    if remaining != 0 {
+        t.Errorf("expected the values of collected refs to be released, %d remain", remaining)
+    }
+}
+
+func TestValue(t *testing.T) {
+    s := Newstate()
+    defer s.Close()
+    s.Openlibs()
+    
+    if err := s.Loadstring(`return {name = "leap", workers = 4, debug = true, tags = {"a", "b", "c"}}`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    config, ok := s.Value(-1).(*Table)
+    s.Pop(1)
+    if !ok {
+        t.Fatal("expected a table value")
+    }
+    defer config.Release()
+    
+    // walk the table
+    found := map[string]int{}
+    err := config.ForEach(func(key, value Value) error {
+        found[string(key.(String))] = value.Type()
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := map[string]int{"name": LUA_TSTRING, "workers": LUA_TNUMBER, "debug": LUA_TBOOLEAN, "tags": LUA_TTABLE}
+    if !reflect.DeepEqual(found, expected) {
+        t.Errorf("expected the fields %v, got %v", expected, found)
+    }
+    if keys := config.Keys(); len(keys) != 4 {
+        t.Errorf("expected 4 keys, got %d", len(keys))
+    }
+    
+    tags, err := config.Get("tags")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n := tags.(*Table).Len(); n != 3 {
+        t.Errorf("expected 3 tags, got %d", n)
+    }
+    if tag, _ := tags.(*Table).Get(2); tag != String("b") {
+        t.Errorf("expected the second tag to be b, got %v", tag)
+    }
+    if missing, _ := config.Get("missing"); missing != (Nil{}) {
+        t.Errorf("expected a missing field to be Nil, got %v", missing)
+    }
+    
+    if err := config.Set("workers", 8); err != nil {
+        t.Fatal(err)
+    }
+    if err := config.Set(nil, 1); err == nil {
+        t.Error("expected an error setting a nil key")
+    }
+    if workers, _ := config.Get("workers"); workers != Number(8) {
+        t.Errorf("expected 8 workers, got %v", workers)
+    }
+    
+    // call functions with values and go values
+    if err := s.Loadstring(`return function(config, n) return config.workers * n, config end`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    fn := s.Value(-1).(*Function)
+    s.Pop(1)
+    results, err := fn.Call(config, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 2 || results[0] != Number(16) || results[1].Type() != LUA_TTABLE {
+        t.Errorf("expected 16 and the config table, got %v", results)
+    }
+    if _, err := fn.Call(); err == nil {
+        t.Error("expected an error calling the function without arguments")
+    }
+    if s.Gettop() != 0 {
+        t.Errorf("expected an empty stack, got %d values", s.Gettop())
+    }
+    
+    // convert arguments to values
+    var got []Value
+    if err := s.RegisterFunc("collect", func(table *Table, fn *Function, any Value) {
+        got = []Value{table, fn, any}
+    }); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Loadstring(`collect({}, print, coroutine.create(print))`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    if len(got) != 3 || got[2].Type() != LUA_TTHREAD || got[2].(*Thread).State() == nil {
+        t.Errorf("expected a table, a function and a thread, got %v", got)
+    }
+    if err := s.Loadstring(`local ok, err = pcall(collect, {}, {}); return err`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    if message := s.Tostring(-1); !strings.Contains(message, "function expected, got table") {
+        t.Errorf("expected a function argument error, got %q", message)
+    }
+    s.Pop(1)
+    
+    // keys do not hold the values, so they take no reference, and released tables
+    // are empty
+    if err := s.Loadstring(`return {a = {}, b = {}, c = function() end}`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 1, 0); err != nil {
+        t.Fatal(err)
+    }
+    nested := s.Value(-1).(*Table)
+    s.Pop(1)
+    s.Pushboolean(true)
+    free := s.Ref(LUA_REGISTRYINDEX)
+    s.Unref(LUA_REGISTRYINDEX, free)
+    if keys := nested.Keys(); len(keys) != 3 {
+        t.Errorf("expected 3 keys, got %d", len(keys))
+    }
+    s.Pushboolean(true)
+    if ref := s.Ref(LUA_REGISTRYINDEX); ref != free {
+        t.Errorf("expected Keys not to hold the values, got ref %d instead of the free ref %d", ref, free)
+    }
+    
+    nested.Release()
+    if keys := nested.Keys(); len(keys) != 0 || nested.Len() != 0 {
+        t.Errorf("expected a released table to be empty, got %d keys", len(keys))
+    }
+    if _, err := nested.Get("a"); err != ErrReleasedValue {
+        t.Errorf("expected ErrReleasedValue from Get, got %v", err)
+    }
+    if err := nested.Set("a", 1); err != ErrReleasedValue {
+        t.Errorf("expected ErrReleasedValue from Set, got %v", err)
+    }
+    if err := nested.ForEach(func(key, value Value) error { return nil }); err != ErrReleasedValue {
+        t.Errorf("expected ErrReleasedValue from ForEach, got %v", err)
+    }
+    fn.Release()
+    if _, err := fn.Call(); err != ErrReleasedValue {
+        t.Errorf("expected ErrReleasedValue from Call, got %v", err)
+    }
+}
+
+// runchunks runs the lua chunk of each case and checks that it returns the string 
+// expected by the case
+func runchunks(t *testing.T, s *State, cases [][2]string) {
+    t.Helper()
+    for _, c := range cases {
+        if err := s.Loadstring(c[0]); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Pcall(0, 1, 0); err != nil {
+            t.Fatal(err)
+        }
+        if result := s.Tostring(-1); result != c[1] {
+            t.Errorf("expected %q from %s, got %q", c[1], c[0], result)
+        }
+        s.Pop(1)
+    }
+}
\ No newline at end of file
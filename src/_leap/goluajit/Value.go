@@ -0,0 +1,368 @@
+package luajit
+
+import(
+    "errors"
+    "math"
+    "reflect"
+    "unsafe"
+)
+
+// valuetype is the reflect.Type of Value, and valuetypenames the lua type names of the
+// types implementing it
+var valuetype reflect.Type = reflect.TypeOf((*Value)(nil)).Elem()
+var valuetypenames map[reflect.Type]string = map[reflect.Type]string{
+    valuetype: "",
+    reflect.TypeOf(Nil{}): "nil",
+    reflect.TypeOf(Bool(false)): "boolean",
+    reflect.TypeOf(Number(0)): "number",
+    reflect.TypeOf(String("")): "string",
+    reflect.TypeOf((*Table)(nil)): "table",
+    reflect.TypeOf((*Function)(nil)): "function",
+    reflect.TypeOf((*Userdata)(nil)): "userdata",
+    reflect.TypeOf((*Thread)(nil)): "thread",
+}
+
+// ErrReleasedValue is returned by the methods of a Table, Function, Userdata or Thread
+// once it was released
+var ErrReleasedValue error = errors.New("VALUE: value is released")
+
+// A Value is a lua value held by go, returned by State.Value: Nil, Bool, Number,
+// String, *Table, *Function, *Userdata or *Thread. Values are pushed back with Push,
+// and ToValue and NewFunc convert lua values to go values of these types.
+//
+// Tables, functions, userdata and threads are held with a Ref, so they are not
+// collected while go holds them. Release them once they are no longer needed, or the
+// go garbage collector releases them later, see Ref. Their methods use the State of
+// the Ref, so the Gil must be held.
+type Value interface {
+    // Type returns the lua type of the value, such as LUA_TTABLE
+    Type() int
+    
+    // push pushes the value onto the stack of s
+    push(s *State) error
+}
+
+// Nil is the lua nil
+type Nil struct{}
+
+// Bool is a lua boolean
+type Bool bool
+
+// Number is a lua number
+type Number float64
+
+// String is a lua string, which may hold any bytes
+type String string
+
+func (this Nil) Type() int {
+    return LUA_TNIL
+}
+
+func (this Nil) push(s *State) error {
+    s.Pushnil()
+    return nil
+}
+
+func (this Bool) Type() int {
+    return LUA_TBOOLEAN
+}
+
+func (this Bool) push(s *State) error {
+    s.Pushboolean(bool(this))
+    return nil
+}
+
+func (this Number) Type() int {
+    return LUA_TNUMBER
+}
+
+func (this Number) push(s *State) error {
+    s.Pushnumber(float64(this))
+    return nil
+}
+
+func (this String) Type() int {
+    return LUA_TSTRING
+}
+
+func (this String) push(s *State) error {
+    s.Pushlstring([]byte(this))
+    return nil
+}
+
+// A reference is the Ref of a Table, Function, Userdata or Thread
+type reference struct {
+    ref *Ref
+}
+
+// Release releases the Ref of the value, see Ref.Release. The value is nil afterwards,
+// and its methods return ErrReleasedValue or an empty result.
+func (this *reference) Release() {
+    this.ref.Release()
+}
+
+// Released returns whether the value was released.
+func (this *reference) Released() bool {
+    return this.ref.Released()
+}
+
+// push pushes the referenced value onto the stack of s, which must be the State of the
+// Ref or another thread of its global state
+func (this *reference) push(s *State) error {
+    if s.gvindex != this.ref.state.gvindex {
+        return errors.New("PUSH: cannot push value of another lua state")
+    }
+    if this.ref.Released() {
+        s.Pushnil()
+        return nil
+    }
+    s.Rawgeti(LUA_REGISTRYINDEX, this.ref.ref)
+    return nil
+}
+
+// state returns the State of the Ref, after checking that it can grow its stack by n
+func (this *reference) state(n int) *State {
+    s := this.ref.state
+    if !s.Checkstack(n) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    return s
+}
+
+// Table is a lua table. Its methods access the table without calling metamethods,
+// like Rawget and Rawset.
+type Table struct {
+    reference
+}
+
+func (this *Table) Type() int {
+    return LUA_TTABLE
+}
+
+// Get returns the value of the table at key, a go value pushed as by Push.
+func (this *Table) Get(key interface{}) (Value, error) {
+    if this.Released() {
+        return Nil{}, ErrReleasedValue
+    }
+    s := this.state(2)
+    top := s.Gettop()
+    defer s.Settop(top)
+    
+    this.push(s)
+    if err := s.Push(key); err != nil {
+        return nil, err
+    }
+    s.Rawget(-2)
+    return s.Value(-1), nil
+}
+
+// Set sets the value of the table at key to value, go values pushed as by Push. A
+// nil value removes the key from the table.
+func (this *Table) Set(key, value interface{}) error {
+    if this.Released() {
+        return ErrReleasedValue
+    }
+    s := this.state(3)
+    top := s.Gettop()
+    defer s.Settop(top)
+    
+    this.push(s)
+    if err := s.Push(key); err != nil {
+        return err
+    }
+    if s.Isnil(-1) {
+        return errors.New("VALUE: table index is nil")
+    }
+    if s.Isnumber(-1) && math.IsNaN(s.Tonumber(-1)) {
+        return errors.New("VALUE: table index is NaN")
+    }
+    if err := s.Push(value); err != nil {
+        return err
+    }
+    s.Rawset(-3)
+    return nil
+}
+
+// Len returns the length of the table, as the # operator without metamethods, or 0
+// once the table is released.
+func (this *Table) Len() int {
+    if this.Released() {
+        return 0
+    }
+    s := this.state(1)
+    this.push(s)
+    defer s.Pop(1)
+    
+    return s.Objlen(-1)
+}
+
+// ForEach calls fn with every key and value of the table, in the order of Next, until
+// fn returns an error, which ForEach returns. fn must not add keys to the table, but
+// it may set or clear existing keys. Like the results of State.Value, the keys and
+// values are held until fn releases them or go collects them.
+func (this *Table) ForEach(fn func(key, value Value) error) error {
+    if this.Released() {
+        return ErrReleasedValue
+    }
+    s := this.state(3)
+    top := s.Gettop()
+    defer s.Settop(top)
+    
+    this.push(s)
+    table := s.Gettop()
+    s.Pushnil()
+    for s.Next(table) {
+        key, value := s.Value(-2), s.Value(-1)
+        if err := fn(key, value); err != nil {
+            return err
+        }
+        
+        // leave only the key for Next, whatever fn did with the stack
+        s.Settop(table + 1)
+    }
+    return nil
+}
+
+// Keys returns the keys of the table, in the order of Next, or no keys once the table
+// is released. The values are not held.
+func (this *Table) Keys() []Value {
+    keys := []Value{}
+    if this.Released() {
+        return keys
+    }
+    s := this.state(3)
+    top := s.Gettop()
+    defer s.Settop(top)
+    
+    this.push(s)
+    table := s.Gettop()
+    s.Pushnil()
+    for s.Next(table) {
+        s.Pop(1)
+        keys = append(keys, s.Value(-1))
+    }
+    return keys
+}
+
+// Function is a lua function, or a Gofunction
+type Function struct {
+    reference
+}
+
+func (this *Function) Type() int {
+    return LUA_TFUNCTION
+}
+
+// Call calls the function in protected mode, like Pcall, with args pushed as by Push,
+// and returns all its results. The returned error is a *LuaError for lua errors.
+func (this *Function) Call(args ...interface{}) ([]Value, error) {
+    if this.Released() {
+        return nil, ErrReleasedValue
+    }
+    s := this.state(len(args) + 1)
+    top := s.Gettop()
+    
+    this.push(s)
+    for _, arg := range args {
+        if err := s.Push(arg); err != nil {
+            s.Settop(top)
+            return nil, err
+        }
+    }
+    if err := s.Pcall(len(args), LUA_MULTRET, 0); err != nil {
+        s.Settop(top)
+        return nil, err
+    }
+    
+    results := make([]Value, s.Gettop() - top)
+    for i := range results {
+        results[i] = s.Value(top + 1 + i)
+    }
+    s.Settop(top)
+    return results, nil
+}
+
+// Userdata is a full or light userdata
+type Userdata struct {
+    reference
+    light bool
+}
+
+func (this *Userdata) Type() int {
+    if this.light {
+        return LUA_TLIGHTUSERDATA
+    }
+    return LUA_TUSERDATA
+}
+
+// Pointer returns the block address of a full userdata, or the pointer of a light one,
+// and nil once the userdata is released.
+func (this *Userdata) Pointer() unsafe.Pointer {
+    if this.Released() {
+        return nil
+    }
+    s := this.state(1)
+    this.push(s)
+    defer s.Pop(1)
+    
+    return s.Touserdata(-1)
+}
+
+// Togouserdata returns the go value of a userdata made by NewGouserdata with the type
+// typename, and false for other userdata or once the userdata is released.
+func (this *Userdata) Togouserdata(typename string) (interface{}, bool) {
+    if this.Released() {
+        return nil, false
+    }
+    s := this.state(1)
+    this.push(s)
+    defer s.Pop(1)
+    
+    return s.Togouserdata(-1, typename)
+}
+
+// Thread is a lua thread, such as a coroutine
+type Thread struct {
+    reference
+}
+
+func (this *Thread) Type() int {
+    return LUA_TTHREAD
+}
+
+// State returns the State of the thread, or nil once the Thread is released. It is
+// valid while the Thread is held.
+func (this *Thread) State() *State {
+    if this.Released() {
+        return nil
+    }
+    s := this.state(1)
+    this.push(s)
+    defer s.Pop(1)
+    
+    return s.Tothread(-1)
+}
+
+// Value returns the value at the given index as a Value. Tables, functions, userdata
+// and threads are held with a new Ref. An invalid index returns Nil.
+func (this *State) Value(index int) Value {
+    switch this.Type(index) {
+        case LUA_TBOOLEAN:
+            return Bool(this.Toboolean(index))
+        case LUA_TNUMBER:
+            return Number(this.Tonumber(index))
+        case LUA_TSTRING:
+            return String(this.Tolstring(index))
+        case LUA_TTABLE:
+            return &Table{reference{this.NewRef(index)}}
+        case LUA_TFUNCTION:
+            return &Function{reference{this.NewRef(index)}}
+        case LUA_TUSERDATA:
+            return &Userdata{reference: reference{this.NewRef(index)}}
+        case LUA_TLIGHTUSERDATA:
+            return &Userdata{reference: reference{this.NewRef(index)}, light: true}
+        case LUA_TTHREAD:
+            return &Thread{reference{this.NewRef(index)}}
+    }
+    return Nil{}
+}
\ No newline at end of file
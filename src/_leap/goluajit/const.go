@@ -3,6 +3,7 @@ package luajit
 /*
 #include <luajit.h>
 #include <lua.h>
+#include <lauxlib.h>
 #include <lualib.h>
 */
 import "C"
@@ -30,6 +31,12 @@ const(
 	LUA_GLOBALSINDEX  = int(C.LUA_GLOBALSINDEX)
 )
 
+// Reference constants, see Ref
+const(
+    LUA_NOREF  = int(C.LUA_NOREF)
+    LUA_REFNIL = int(C.LUA_REFNIL)
+)
+
 // Error constants
 const(
     LUA_ERRERR        = int(C.LUA_ERRERR)
@@ -55,4 +62,32 @@ const (
 	LUA_TFUNCTION      = int(C.LUA_TFUNCTION)
 	LUA_TUSERDATA      = int(C.LUA_TUSERDATA)
 	LUA_TTHREAD        = int(C.LUA_TTHREAD)
+)
+
+// Debug constants
+const (
+	LUA_HOOKCALL    = int(C.LUA_HOOKCALL)
+	LUA_HOOKRET     = int(C.LUA_HOOKRET)
+	LUA_HOOKLINE    = int(C.LUA_HOOKLINE)
+	LUA_HOOKCOUNT   = int(C.LUA_HOOKCOUNT)
+	LUA_HOOKTAILRET = int(C.LUA_HOOKTAILRET)
+	LUA_MASKCALL    = int(C.LUA_MASKCALL)
+	LUA_MASKRET     = int(C.LUA_MASKRET)
+	LUA_MASKLINE    = int(C.LUA_MASKLINE)
+	LUA_MASKCOUNT   = int(C.LUA_MASKCOUNT)
+)
+
+// Jitmode is a mode of the JIT engine ORed with a flag, see State.Setmode
+type Jitmode int
+
+// JIT mode constants
+const (
+	LUAJIT_MODE_ENGINE     = Jitmode(C.LUAJIT_MODE_ENGINE)
+	LUAJIT_MODE_FUNC       = Jitmode(C.LUAJIT_MODE_FUNC)
+	LUAJIT_MODE_ALLFUNC    = Jitmode(C.LUAJIT_MODE_ALLFUNC)
+	LUAJIT_MODE_ALLSUBFUNC = Jitmode(C.LUAJIT_MODE_ALLSUBFUNC)
+	LUAJIT_MODE_TRACE      = Jitmode(C.LUAJIT_MODE_TRACE)
+	LUAJIT_MODE_OFF        = Jitmode(C.LUAJIT_MODE_OFF)
+	LUAJIT_MODE_ON         = Jitmode(C.LUAJIT_MODE_ON)
+	LUAJIT_MODE_FLUSH      = Jitmode(C.LUAJIT_MODE_FLUSH)
 )
\ No newline at end of file
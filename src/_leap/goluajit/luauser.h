@@ -1,2 +0,0 @@
-#define lua_lock(L) goluajit_lualock(L)
-#define lua_unlock(L) goluajit_luaunlock(L)
\ No newline at end of file
@@ -4,11 +4,12 @@ import(
     "sync"
 )
 
-// gvregistry holds golang values in which their registry indexes are to be passed 
-// to the C runtime. upon return from the C runtime, we can use the Registry Indexes 
-// sent back from C to obtain our real values. NEVER EVER SEND GOLANG POINTERS TO C. 
-// golang may change pointer values during scheduling and GC, so references to go 
-// pointers in C may age-out 
-var Gvregistry *GovalueRegistry = NewGovalueRegistry()
+// lastindex is the last index handed out to a root State or to a value of any 
+// GovalueRegistry. Indexes are unique across the process, so an index obtained
+// from the registry of one state is never found in the registry of another. It 
+// is only accessed atomically.
+var lastindex int64
 
-var GlobalMutex *sync.Mutex = &sync.Mutex{}
\ No newline at end of file
+// rootstates maps the gvindex of every open State created by Newstate to that State. It 
+// is read without locking on every call from lua into go.
+var rootstates *sync.Map = &sync.Map{}
@@ -0,0 +1,218 @@
+package nsleap
+
+import(
+    "time"
+    
+    "_leap/goluajit"
+)
+
+// CHANNEL_TYPENAME is the name of the metatable of Channel userdata
+const CHANNEL_TYPENAME = "leap.Channel"
+
+// Channel is a go channel exposed to lua. Values sent on a Channel are deep copied as 
+// messages (see Worker), so the receiving thread never shares a table with the sender.
+type Channel struct {
+    ch chan interface{}
+}
+
+// channelmetatable is the metatable shared by all Channel userdata
+var channelmetatable *luajit.Gometatable = &luajit.Gometatable{
+    Name: CHANNEL_TYPENAME,
+    Metatable: CHANNEL_TYPENAME,
+    Methods: map[string]luajit.Gofunction{
+        "send": channelmethod((*Channel).send),
+        "recv": channelmethod((*Channel).recv),
+        "trysend": channelmethod((*Channel).trysend),
+        "tryrecv": channelmethod((*Channel).tryrecv),
+        "close": channelmethod((*Channel).close),
+        "len": channelmethod((*Channel).len),
+    },
+}
+
+// channelmethod adapts a Channel method to a Gofunction called on the Channel userdata
+func channelmethod(method func(*Channel, *luajit.State) int) luajit.Gofunction {
+    return func(ls *luajit.State) int {
+        return method(ls.CheckGouserdata(1, CHANNEL_TYPENAME).(*Channel), ls)
+    }
+}
+
+func NewChannel(ls *luajit.State) int {
+    capacity := 0
+    if ls.Gettop() >= 1 {
+        if !ls.Isnumber(1) || ls.Tointeger(1) < 0 {
+            ls.Pushstring("leap.Channel() capacity must be a non-negative number")
+            ls.Error()
+        }
+        capacity = ls.Tointeger(1)
+    }
+    
+    channel := &Channel{
+        ch: make(chan interface{}, capacity),
+    }
+    channel.push(ls)
+    
+    return 1
+}
+
+// After returns a Channel on which the current time, in seconds since the unix epoch, 
+// is sent once the given number of seconds has elapsed.
+func After(ls *luajit.State) int {
+    if ls.Gettop() < 1 || !ls.Isnumber(1) {
+        ls.Pushstring("You must supply a number of seconds to leap.after()")
+        ls.Error()
+    }
+    duration := time.Duration(ls.Tonumber(1) * float64(time.Second))
+    
+    channel := &Channel{
+        ch: make(chan interface{}, 1),
+    }
+    time.AfterFunc(duration, func() {
+        now := time.Now()
+        channel.ch <- float64(now.UnixNano()) / float64(time.Second)
+    })
+    channel.push(ls)
+    
+    return 1
+}
+
+// push pushes a new userdata representing the channel onto the stack
+func (this *Channel) push(ls *luajit.State) {
+    // Build the shared metatable on first use
+    ls.Pushmetatable(channelmetatable)
+    ls.Pop(1)
+    
+    ls.NewGouserdata(this, CHANNEL_TYPENAME)
+}
+
+// send blocks until its argument is sent on the channel. Sending on a closed channel is 
+// an error, and a blocked send is interrupted along with the calling code.
+func (this *Channel) send(ls *luajit.State) int {
+    msg, copyerr := copymessage(ls, 2); if copyerr != nil {
+        ls.Pushstring(copyerr.Error())
+        ls.Error()
+    }
+    
+    ctx := ls.Context()
+    sent := false
+    ls.Unlocked(func() {
+        sent = this.dosend(msg, true, ctx.Done())
+    })
+    if !sent && ctx.Err() != nil {
+        ls.Pushstring("Send on channel interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    if !sent {
+        ls.Pushstring("Attempt to send on a closed channel")
+        ls.Error()
+    }
+    
+    return 0
+}
+
+// trysend sends its argument on the channel if it can do so without blocking, and 
+// returns whether the value was sent. A closed channel never accepts a value.
+func (this *Channel) trysend(ls *luajit.State) int {
+    msg, copyerr := copymessage(ls, 2); if copyerr != nil {
+        ls.Pushstring(copyerr.Error())
+        ls.Error()
+    }
+    
+    ls.Pushboolean(this.dosend(msg, false, nil))
+    
+    return 1
+}
+
+// dosend sends msg on the channel, returning false if the channel is closed or, when 
+// block is false, if the send would block. A blocking send also gives up once done is
+// closed.
+func (this *Channel) dosend(msg interface{}, block bool, done <-chan struct{}) (sent bool) {
+    defer func() {
+        // a send on a closed go channel panics
+        if r := recover(); r != nil {
+            sent = false
+        }
+    }()
+    
+    if block {
+        select {
+            case this.ch <- msg:
+                return true
+            case <- done:
+                return false
+        }
+    }
+    
+    select {
+        case this.ch <- msg:
+            return true
+        default:
+            return false
+    }
+}
+
+// recv blocks until a value is received and returns it with true, or returns nil and 
+// false once the channel is closed and drained. A blocked receive is interrupted along 
+// with the calling code.
+func (this *Channel) recv(ls *luajit.State) int {
+    ctx := ls.Context()
+    var msg interface{}
+    var ok, interrupted bool
+    ls.Unlocked(func() {
+        select {
+            case msg, ok = <- this.ch:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Receive from channel interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    
+    pushmessage(ls, msg)
+    ls.Pushboolean(ok)
+    
+    return 2
+}
+
+// tryrecv returns a value and true if one can be received without blocking, or nil and
+// false otherwise.
+func (this *Channel) tryrecv(ls *luajit.State) int {
+    var msg interface{}
+    var ok bool
+    select {
+        case msg, ok = <- this.ch:
+        default:
+    }
+    
+    pushmessage(ls, msg)
+    ls.Pushboolean(ok)
+    
+    return 2
+}
+
+// close closes the channel. Closing a closed channel is an error.
+func (this *Channel) close(ls *luajit.State) int {
+    closed := func() (ok bool) {
+        defer func() {
+            if r := recover(); r != nil {
+                ok = false
+            }
+        }()
+        close(this.ch)
+        return true
+    }()
+    if !closed {
+        ls.Pushstring("Attempt to close a closed channel")
+        ls.Error()
+    }
+    
+    return 0
+}
+
+// len returns the number of values queued in the channel buffer.
+func (this *Channel) len(ls *luajit.State) int {
+    ls.Pushnumber(float64(len(this.ch)))
+    
+    return 1
+}
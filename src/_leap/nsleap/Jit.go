@@ -0,0 +1,45 @@
+package nsleap
+
+import(
+    "_leap/goluajit"
+)
+
+// JitOn, JitOff and JitFlush implement leap.jit.on, leap.jit.off and leap.jit.flush. Like 
+// the functions of the luajit jit module, they apply to the whole JIT engine when called 
+// without arguments, or to a lua function and, if the second argument is true, all of 
+// its sub-functions:
+//
+// 	leap.jit.off(parse, true)  -- never compile parse and the functions it defines
+// 	leap.jit.flush()           -- throw away all compiled code
+func JitOn(ls *luajit.State) int {
+    return setjitmode(ls, "on", luajit.LUAJIT_MODE_ON)
+}
+
+func JitOff(ls *luajit.State) int {
+    return setjitmode(ls, "off", luajit.LUAJIT_MODE_OFF)
+}
+
+func JitFlush(ls *luajit.State) int {
+    return setjitmode(ls, "flush", luajit.LUAJIT_MODE_FLUSH)
+}
+
+func setjitmode(ls *luajit.State, name string, flag luajit.Jitmode) int {
+    mode := luajit.LUAJIT_MODE_ENGINE
+    if !ls.Isnoneornil(1) {
+        if !ls.Isfunction(1) || ls.Isgofunction(1) {
+            ls.Pushstring("leap.jit."+name+"() expects a lua function or no argument")
+            ls.Error()
+        }
+        mode = luajit.LUAJIT_MODE_FUNC
+        if ls.Toboolean(2) {
+            mode = luajit.LUAJIT_MODE_ALLFUNC
+        }
+    }
+    
+    if err := ls.Setmode(1, mode|flag); err != nil {
+        ls.Pushstring("leap.jit."+name+"() failed: "+err.Error())
+        ls.Error()
+    }
+    
+    return 0
+}
\ No newline at end of file
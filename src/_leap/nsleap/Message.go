@@ -0,0 +1,103 @@
+package nsleap
+
+import(
+    "errors"
+    "unsafe"
+    
+    "_leap/goluajit"
+)
+
+// A message is a deep copy of a lua value held on the go side, so that it may be passed
+// between independent lua states. Messages are made of nil, bool, float64, string and 
+// messagetable values.
+type messagetable []messagefield
+
+type messagefield struct {
+    key interface{}
+    value interface{}
+}
+
+// copymessage deep copies the lua value at index into a message. Functions, userdata, 
+// threads and cyclic tables cannot be copied.
+func copymessage(ls *luajit.State, index int) (interface{}, error) {
+    if index < 0 && index > luajit.LUA_REGISTRYINDEX {
+        index = ls.Gettop() + index + 1
+    }
+    
+    return copyvalue(ls, index, make(map[unsafe.Pointer]bool))
+}
+
+func copyvalue(ls *luajit.State, index int, seen map[unsafe.Pointer]bool) (interface{}, error) {
+    switch ls.Type(index) {
+        case luajit.LUA_TNIL, luajit.LUA_TNONE:
+            return nil, nil
+        case luajit.LUA_TBOOLEAN:
+            return ls.Toboolean(index), nil
+        case luajit.LUA_TNUMBER:
+            return ls.Tonumber(index), nil
+        case luajit.LUA_TSTRING:
+            return string(ls.Tolstring(index)), nil
+        case luajit.LUA_TTABLE:
+            return copytable(ls, index, seen)
+        default:
+            return nil, errors.New("Unable to copy value of type " + ls.Typename(index))
+    }
+}
+
+func copytable(ls *luajit.State, index int, seen map[unsafe.Pointer]bool) (interface{}, error) {
+    ptr := ls.Topointer(index)
+    if seen[ptr] {
+        return nil, errors.New("Unable to copy cyclic table")
+    }
+    seen[ptr] = true
+    defer delete(seen, ptr)
+    
+    if !ls.Checkstack(2) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    
+    table := messagetable{}
+    
+    ls.Pushnil()
+    for ls.Next(index) {
+        key, keyerr := copyvalue(ls, ls.Gettop()-1, seen); if keyerr != nil {
+            ls.Pop(2)
+            return nil, keyerr
+        }
+        value, valueerr := copyvalue(ls, ls.Gettop(), seen); if valueerr != nil {
+            ls.Pop(2)
+            return nil, valueerr
+        }
+        table = append(table, messagefield{key: key, value: value})
+        ls.Pop(1)
+    }
+    
+    return table, nil
+}
+
+// pushmessage pushes a fresh lua value built from msg onto the stack. Strings are copied
+// whole, embedded zeros included.
+func pushmessage(ls *luajit.State, msg interface{}) {
+    switch value := msg.(type) {
+        case nil:
+            ls.Pushnil()
+        case bool:
+            ls.Pushboolean(value)
+        case float64:
+            ls.Pushnumber(value)
+        case string:
+            ls.Pushlstring([]byte(value))
+        case messagetable:
+            ls.Createtable(0, len(value))
+            if !ls.Checkstack(2) {
+                panic("STATE: unable to grow lua_state stack")
+            }
+            for _, field := range value {
+                pushmessage(ls, field.key)
+                pushmessage(ls, field.value)
+                ls.Rawset(-3)
+            }
+        default:
+            panic("Invalid Message Value")
+    }
+}
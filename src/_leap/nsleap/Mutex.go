@@ -1,72 +1,53 @@
 package nsleap
 
 import(
-    "log"
-    "sync"
-    
     "_leap/goluajit"    
 )
 
+// Mutex is a lock shared by lua threads, pushed as a userdata with the lock and unlock
+// methods, called as mu:lock() and mu:unlock()
 type Mutex struct {
-    Ticket chan int
-    Gvindex int
-    mu *sync.Mutex
+    ticket chan int
 }
 
 func NewMutex(ls *luajit.State) int {
-    luajit.GlobalMutex.Lock()
-    defer luajit.GlobalMutex.Unlock()
-    
     mu := &Mutex{
-        Ticket: make(chan int, 1),
-        mu: &sync.Mutex{},
+        ticket: make(chan int, 1),
     }
-    mu.Ticket <- 1
-    
-    // Obtain a gvindex 
-    mu.Gvindex = luajit.Gvregistry.AddValue(mu)
-    
-    // Create new userdata. This will be returned
-    ls.Newtable()
-    
-    // Push mutex.Lock
-    ls.Pushfunction(mu.lock)
-    ls.Setfield(-2, "lock")
-    
-    // Push mutex.Unlock
-    ls.Pushfunction(mu.unlock)
-    ls.Setfield(-2, "unlock")
-    
-    // Create metatable for userdat
-    ls.Pushmetatable(&luajit.Gometatable{
-        IndexFunction: mu.index,
-        GCFunction: mu.gc,
-    })
-    
-    // Set metatable for userdata
-    ls.Setmetatable(-2,)
+    mu.ticket <- 1
     
-    return 1
-}
-
-func (this *Mutex) index(ls *luajit.State) int {    
-    ls.Getfield(-2, ls.Tostring(-1))
+    // Push the mutex userdata. This will be returned
+    if pusherr := ls.PushObject(mu); pusherr != nil {
+        panic(pusherr)
+    }
     
     return 1
 }
 
-func (this *Mutex) gc(ls *luajit.State) int {
-    log.Println("MUTEX GC")
-    luajit.Gvregistry.RemoveValue(this.Gvindex)
-    return 0
-}
-
-func (this *Mutex) lock(ls *luajit.State) int {    
-    <- this.Ticket
-    return 0
+// Lock waits for the mutex without holding the Gil, and is interrupted along with the
+// calling code
+func (this *Mutex) Lock(ls *luajit.State) {
+    ctx := ls.Context()
+    interrupted := false
+    ls.Unlocked(func() {
+        select {
+            case <- this.ticket:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Lock of mutex interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
 }
 
-func (this *Mutex) unlock(ls *luajit.State) int {    
-    this.Ticket <- 1
-    return 0
+// Unlock releases the mutex, raising an error if it is not locked
+func (this *Mutex) Unlock(ls *luajit.State) {
+    select {
+        case this.ticket <- 1:
+        default:
+            ls.Pushstring("unlock of unlocked mutex")
+            ls.Error()
+    }
 }
\ No newline at end of file
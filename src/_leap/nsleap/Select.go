@@ -0,0 +1,180 @@
+package nsleap
+
+import(
+    "errors"
+    "fmt"
+    "reflect"
+    
+    "_leap/goluajit"
+)
+
+// Select blocks until one of several channel operations can proceed, like a go select 
+// statement. It takes a table of cases, each of which is a table holding a Channel, an 
+// optional direction, "recv" (the default) or "send", and for sends the value to send.
+// A case may also hold a thread handle, which fires with a nil value and a false ok flag
+// once the thread has finished:
+//
+// 	local i, v, ok = leap.select{
+// 		{results, "recv"},
+// 		{jobs, "send", job},
+// 		{leap.after(1.5)},
+// 		{handle},
+// 		default = function() return "nothing ready" end,
+// 	}
+//
+// Select returns the index of the case that fired followed, for receives, by the value
+// received and an ok flag that is false if the channel was closed. If the default field is
+// present and no case is ready, Select returns "default" followed by the results of 
+// calling default when it is a function.
+func Select(ls *luajit.State) int {
+    if ls.Gettop() < 1 || !ls.Istable(1) {
+        ls.Pushstring("You must supply a table of cases to leap.select()")
+        ls.Error()
+    }
+    ls.Settop(1)
+    
+    cases, caseserr := selectcases(ls); if caseserr != nil {
+        ls.Pushstring(caseserr.Error())
+        ls.Error()
+    }
+    
+    ls.Getfield(1, "default")
+    hasdefault := !ls.Isnil(-1)
+    if hasdefault {
+        cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+    }
+    
+    // Without a default, a blocked select is interrupted along with the calling code
+    ctx := ls.Context()
+    interruptcase := -1
+    if !hasdefault && ctx.Done() != nil {
+        interruptcase = len(cases)
+        cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+    }
+    
+    var chosen int
+    var recv reflect.Value
+    var recvok bool
+    var selecterr error
+    ls.Unlocked(func() {
+        defer func() {
+            // a send on a closed go channel panics
+            if r := recover(); r != nil {
+                selecterr = errors.New("Attempt to send on a closed channel in leap.select()")
+            }
+        }()
+        chosen, recv, recvok = reflect.Select(cases)
+    })
+    if selecterr != nil {
+        ls.Pushstring(selecterr.Error())
+        ls.Error()
+    }
+    if chosen == interruptcase {
+        ls.Pushstring("leap.select() interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    
+    // The default case fired
+    if hasdefault && chosen == len(cases) - 1 {
+        ls.Pushstring("default")
+        ls.Insert(2)
+        if !ls.Isfunction(-1) {
+            ls.Pop(1)
+            return 1
+        }
+        // a Gofunction may not let lua errors unwind through it, so errors of the
+        // default function are caught and raised again
+        if ls.Pcall(0, luajit.LUA_MULTRET, 0) != nil {
+            ls.Error()
+        }
+        return ls.Gettop() - 1
+    }
+    
+    ls.Pushnumber(float64(chosen + 1))
+    if cases[chosen].Dir == reflect.SelectSend {
+        return 1
+    }
+    
+    if recvok {
+        pushmessage(ls, recv.Interface())
+    } else {
+        ls.Pushnil()
+    }
+    ls.Pushboolean(recvok)
+    
+    return 3
+}
+
+// selectcases reads the array of case tables of the leap.select() argument at index 1
+func selectcases(ls *luajit.State) ([]reflect.SelectCase, error) {
+    cases := []reflect.SelectCase{}
+    
+    for i := 1; ; i++ {
+        ls.Rawgeti(1, i)
+        if ls.Isnil(-1) {
+            ls.Pop(1)
+            return cases, nil
+        }
+        if !ls.Istable(-1) {
+            ls.Pop(1)
+            return nil, fmt.Errorf("leap.select() case #%d must be a table", i)
+        }
+        
+        caseindex := ls.Gettop()
+        selectcase, caseerr := selectcase(ls, caseindex); if caseerr != nil {
+            ls.Settop(caseindex - 1)
+            return nil, fmt.Errorf("leap.select() case #%d: %s", i, caseerr.Error())
+        }
+        cases = append(cases, selectcase)
+        ls.Settop(caseindex - 1)
+    }
+}
+
+// selectcase builds the reflect.SelectCase for the case table at index
+func selectcase(ls *luajit.State, index int) (reflect.SelectCase, error) {
+    ls.Rawgeti(index, 1)
+    channel, channelerr := toselectchan(ls, -1); if channelerr != nil {
+        return reflect.SelectCase{}, channelerr
+    }
+    
+    ls.Rawgeti(index, 2)
+    direction := "recv"
+    if !ls.Isnil(-1) {
+        direction = ls.Tostring(-1)
+    }
+    
+    switch direction {
+        case "recv":
+            return reflect.SelectCase{
+                Dir: reflect.SelectRecv,
+                Chan: channel,
+            }, nil
+        case "send":
+            if channel.Type().ChanDir() & reflect.SendDir == 0 {
+                return reflect.SelectCase{}, errors.New("cannot send to a thread handle")
+            }
+            ls.Rawgeti(index, 3)
+            msg, copyerr := copymessage(ls, -1); if copyerr != nil {
+                return reflect.SelectCase{}, copyerr
+            }
+            return reflect.SelectCase{
+                Dir: reflect.SelectSend,
+                Chan: channel,
+                Send: reflect.ValueOf(&msg).Elem(),
+            }, nil
+        default:
+            return reflect.SelectCase{}, errors.New("direction must be \"recv\" or \"send\", got \"" + direction + "\"")
+    }
+}
+
+// toselectchan returns the go channel of the Channel or thread handle represented by 
+// the lua value at index
+func toselectchan(ls *luajit.State, index int) (reflect.Value, error) {
+    if channel, ok := ls.Togouserdata(index, CHANNEL_TYPENAME); ok {
+        return reflect.ValueOf(channel.(*Channel).ch), nil
+    }
+    if handle, ok := ls.Togouserdata(index, THREADHANDLE_TYPENAME); ok {
+        return reflect.ValueOf((<-chan bool)(handle.(*ThreadHandle).done)), nil
+    }
+    return reflect.Value{}, errors.New("channel or thread expected, got " + ls.Typename(index))
+}
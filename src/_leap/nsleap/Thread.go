@@ -1,84 +1,265 @@
 package nsleap
 
 import(
-    "log"
+    "context"
+    "errors"
     "sync"
+    "time"
     
     "_leap/goluajit"
     "code.google.com/p/go-uuid/uuid"
 )
 
+// Thread status values, as returned by the status() method of a thread handle
+const(
+    THREAD_RUNNING = "running"
+    THREAD_DONE    = "done"
+    THREAD_FAILED  = "failed"
+)
+
+// THREAD_TYPENAME and THREADHANDLE_TYPENAME are the names of the metatables of 
+// Thread and ThreadHandle userdata
+const(
+    THREAD_TYPENAME       = "leap.Thread"
+    THREADHANDLE_TYPENAME = "leap.ThreadHandle"
+)
+
+// Thread is a lua function run on new goroutines, pushed as a userdata whose environment
+// table holds the function
 type Thread struct {
-    mu *sync.Mutex
-    Gvindex int
+    Name string
 }
 
+// threadmetatable is the metatable shared by all Thread userdata
+var threadmetatable *luajit.Gometatable = &luajit.Gometatable{
+    Name: THREAD_TYPENAME,
+    Metatable: THREAD_TYPENAME,
+    Methods: map[string]luajit.Gofunction{
+        "run": func(ls *luajit.State) int {
+            return ls.CheckGouserdata(1, THREAD_TYPENAME).(*Thread).run(ls)
+        },
+    },
+}
+
+// NewThread takes the thread function and an optional name, reported by leap.threads().
 func NewThread(ls *luajit.State) int {        
     if ls.Gettop() < 1 {
         ls.Pushstring("You must supply a function to leap.Thread() constructor")
         ls.Error()
     }
     
-    thread := &Thread{mu: &sync.Mutex{},}
-    thread.Gvindex = luajit.Gvregistry.AddValue(thread)
+    if !ls.Isfunction(1) {
+        ls.Pushstring("leap.Thread() expects a function, got " + ls.Typename(1))
+        ls.Error()
+    }
     
-    // Create new table. This will be returned
-    ls.Newtable()
+    thread := &Thread{}
+    if ls.Gettop() >= 2 {
+        thread.Name = ls.Tostring(2)
+    }
+    ls.Settop(1)
+    
+    // Create new userdata. This will be returned
+    ls.Pushmetatable(threadmetatable)
+    ls.Pop(1)
+    ls.NewGouserdata(thread, THREAD_TYPENAME)
     
-    // Swap arg with table, arg should be at tos
-    ls.Insert(ls.Gettop()-1)    
+    // Keep the function in the environment table of the userdata
+    ls.Newtable()
+    ls.Pushvalue(1)
     ls.Setfield(-2, "func")
+    if fenverr := ls.Setfenv(-2); fenverr != nil {
+        panic(fenverr)
+    }
+    
+    return 1
+}
+
+// run starts the thread function on a new goroutine, passing it any arguments given to 
+// run, and returns a ThreadHandle for it.
+func (this *Thread) run(ls *luajit.State) int {    
+    if ls.Gettop() < 1 {
+        panic("Invalid Stack To Thread Run")
+    }
+    nargs := ls.Gettop() - 1
     
-    // Push func
-    ls.Pushfunction(thread.run)
-    ls.Setfield(-2, "run")
+    threadid := uuid.New()    
     
-    // Create metatable for table
-    ls.Pushmetatable(&luajit.Gometatable{
-        IndexFunction: thread.index,
-        GCFunction: thread.gc,
-    })
+    // Anchor the thread in the registry while it runs
+    pushthreadstable(ls)
+    threadstate := ls.Newthread()
+    ls.Pushvalue(-1)
+    ls.Setfield(-3, threadid)
+    ls.Remove(-2)
     
-    // Set metatable for table
-    ls.Setmetatable(-2)
+    // Move the function and a copy of its arguments to the thread
+    ls.Getfenv(1)
+    ls.Getfield(-1, "func")
+    ls.Remove(-2)
+    for i := 2; i <= nargs + 1; i++ {
+        ls.Pushvalue(i)
+    }
+    threadstate.Xmove(ls, nargs + 1)
+    
+    handle := &ThreadHandle{
+        Id: threadid,
+        Name: this.Name,
+        Started: time.Now(),
+        mu: &sync.Mutex{},
+        state: threadstate,
+        ctx: ls.Context(),
+        status: THREAD_RUNNING,
+        done: make(chan bool),
+    }
+    Threads.add(handle)
+    go handle.run(nargs)
     
+    handle.push(ls)
     return 1
 }
 
-func (this *Thread) index(ls *luajit.State) int {    
-    ls.Getfield(-2, ls.Tostring(-1))
+// ThreadHandle represents one run of a Thread. Its join() method waits for the thread 
+// function to return and returns its results, or raises its error.
+type ThreadHandle struct {
+    Id string
+    Name string
+    Started time.Time
+    mu *sync.Mutex
+    state *luajit.State
+    ctx context.Context
+    status string
+    err error
+    done chan bool
+}
+
+// threadhandlemetatable is the metatable shared by all ThreadHandle userdata
+var threadhandlemetatable *luajit.Gometatable = &luajit.Gometatable{
+    Name: THREADHANDLE_TYPENAME,
+    Metatable: THREADHANDLE_TYPENAME,
+    IndexFunction: threadhandleindex,
+    Methods: map[string]luajit.Gofunction{
+        "join": func(ls *luajit.State) int {
+            return ls.CheckGouserdata(1, THREADHANDLE_TYPENAME).(*ThreadHandle).join(ls)
+        },
+        "status": func(ls *luajit.State) int {
+            return ls.CheckGouserdata(1, THREADHANDLE_TYPENAME).(*ThreadHandle).getstatus(ls)
+        },
+    },
+}
+
+// run calls the thread function in protected mode and leaves its results on the 
+// thread stack. The thread runs under the context of the code that started it, so it 
+// is interrupted along with it.
+func (this *ThreadHandle) run(nargs int) {
+    this.state.Lock()
+    defer this.state.Unlock()
+    defer close(this.done)
+    
+    pcallerr := this.state.PcallContext(this.ctx, nargs, luajit.LUA_MULTRET)
+    
+    // The thread is now only anchored by its handle
+    Threads.remove(this)
+    pushthreadstable(this.state)
+    this.state.Pushnil()
+    this.state.Setfield(-2, this.Id)
+    this.state.Pop(1)
+    
+    this.mu.Lock()
+    defer this.mu.Unlock()
+    
+    if pcallerr != nil {
+        this.err = pcallerr
+        this.status = THREAD_FAILED
+    } else {
+        this.status = THREAD_DONE
+    }
+}
+
+// push pops the thread at the top of the stack and pushes a new userdata representing 
+// the handle in its place. The thread is kept in the environment table of the userdata 
+// so its results outlive its registry entry.
+func (this *ThreadHandle) push(ls *luajit.State) {
+    // Create new userdata. This is left on the stack
+    ls.Pushmetatable(threadhandlemetatable)
+    ls.Pop(1)
+    ls.NewGouserdata(this, THREADHANDLE_TYPENAME)
+    
+    // Move the thread into the environment table
+    ls.Newtable()
+    ls.Pushvalue(-3)
+    ls.Setfield(-2, "thread")
+    if fenverr := ls.Setfenv(-2); fenverr != nil {
+        panic(fenverr)
+    }
+    ls.Remove(-2)
+}
+
+// threadhandleindex is the __index of handles: their id field, or their methods
+func threadhandleindex(ls *luajit.State) int {
+    handle := ls.CheckGouserdata(1, THREADHANDLE_TYPENAME).(*ThreadHandle)
+    if ls.Tostring(2) == "id" {
+        ls.Pushstring(handle.Id)
+        return 1
+    }
+    
+    ls.Getmetatable(1)
+    ls.Getfield(-1, "__methods")
+    ls.Getfield(-1, ls.Tostring(2))
     
     return 1
 }
 
-func (this *Thread) run(ls *luajit.State) int {    
-    if ls.Gettop() < 1 || ls.Gettop() > 1 {
-        panic("Invalid Stack To Thread Run")
+// join blocks until the thread finishes, then returns the results of the thread 
+// function, or raises its error with the thread traceback. A blocked join is 
+// interrupted along with the calling code.
+func (this *ThreadHandle) join(ls *luajit.State) int {
+    ctx := ls.Context()
+    interrupted := false
+    ls.Unlocked(func() {
+        select {
+            case <- this.done:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Join of thread interrupted: " + ctx.Err().Error())
+        ls.Error()
     }
     
-    threadid := uuid.New()    
+    if this.err != nil {
+        var luaerr *luajit.LuaError
+        if errors.As(this.err, &luaerr) {
+            ls.Pushstring(luaerr.Message + "\n" + luaerr.Traceback)
+        } else {
+            ls.Pushstring(this.err.Error())
+        }
+        ls.Error()
+    }
     
-    ls.Getglobal("threads")    
-    threadstate := ls.Newthread()
-    ls.Setfield(ls.Gettop()-1, threadid)  
-    ls.Pop(1)
+    // Copy the results, leaving them on the thread stack for further joins
+    nresults := this.state.Gettop()
+    if !this.state.Checkstack(nresults) || !ls.Checkstack(nresults) {
+        panic("STATE: unable to grow lua_state stack")
+    }
+    for i := 1; i <= nresults; i++ {
+        this.state.Pushvalue(i)
+    }
+    ls.Xmove(this.state, nresults)
     
-    ls.Getfield(-1, "func")
-    threadstate.Xmove(ls, 1)    
-    
-    defer func(threadstate *luajit.State) {
-        go func(threadstate *luajit.State) {
-            if threadstate.Gettop() < 1 || threadstate.Gettop() > 1 {
-                panic("Invalid Threadstate Stack")
-            }
-            //threadstate.Getfield(-2, "func")
-            threadstate.Call(0,0)
-        }(threadstate)
-    }(threadstate)            
-    return 0
+    return nresults
+}
+
+// getstatus returns one of "running", "done" or "failed"
+func (this *ThreadHandle) getstatus(ls *luajit.State) int {
+    ls.Pushstring(this.getstatusstring())
+    
+    return 1
 }
 
-func (this *Thread) gc(ls *luajit.State) int {
-    log.Println("THREAD GC")
-    return 0
-}
\ No newline at end of file
+func (this *ThreadHandle) getstatusstring() string {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+    
+    return this.status
+}
@@ -0,0 +1,186 @@
+package nsleap
+
+import(
+    "sort"
+    "sync"
+    "time"
+    
+    "_leap/goluajit"
+)
+
+// THREADS_REGISTRY_KEY is the key of the table in the lua registry that anchors running 
+// threads, keyed by thread id, so they are not collected while they run.
+const THREADS_REGISTRY_KEY = "nsleap.threads"
+
+// Threads holds every running leap thread of the process. Threads are added when run and
+// removed as soon as their function returns or fails.
+var Threads *ThreadRegistry = NewThreadRegistry()
+
+// ThreadInfo describes a running thread
+type ThreadInfo struct {
+    Id string
+    Name string
+    Status string
+    Started time.Time
+    Source string
+    Line int
+}
+
+// threadrow is a ThreadInfo as returned by leap.threads()
+type threadrow struct {
+    Id string `lua:"id"`
+    Name string `lua:"name"`
+    Status string `lua:"status"`
+    Started float64 `lua:"started"`
+    Source string `lua:"source"`
+    Line int `lua:"line"`
+}
+
+type ThreadRegistry struct {
+    mutex *sync.Mutex
+    threads map[string]*ThreadHandle
+}
+
+func NewThreadRegistry() *ThreadRegistry {
+    return &ThreadRegistry{
+        mutex: &sync.Mutex{},
+        threads: make(map[string]*ThreadHandle),
+    }
+}
+
+func (this *ThreadRegistry) add(handle *ThreadHandle) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    this.threads[handle.Id] = handle
+}
+
+func (this *ThreadRegistry) remove(handle *ThreadHandle) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    delete(this.threads, handle.Id)
+}
+
+// Len returns the number of running threads in all states
+func (this *ThreadRegistry) Len() int {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    
+    return len(this.threads)
+}
+
+// List returns the running threads of the global state of ls, oldest first. The 
+// calling goroutine must hold the Gil of ls, as the current line of each thread is 
+// read from its stack.
+func (this *ThreadRegistry) List(ls *luajit.State) []ThreadInfo {
+    this.mutex.Lock()
+    handles := []*ThreadHandle{}
+    for _, handle := range this.threads {
+        if handle.state.Gil() == ls.Gil() {
+            handles = append(handles, handle)
+        }
+    }
+    this.mutex.Unlock()
+    
+    infos := make([]ThreadInfo, 0, len(handles))
+    for _, handle := range handles {
+        info := ThreadInfo{
+            Id: handle.Id,
+            Name: handle.Name,
+            Status: handle.getstatusstring(),
+            Started: handle.Started,
+        }
+        info.Source, info.Line = currentline(ls, handle.Id)
+        infos = append(infos, info)
+    }
+    sort.Sort(threadinfos(infos))
+    
+    return infos
+}
+
+// currentline returns the source and line currently executed by the running thread 
+// threadid, using debug.getinfo from ls. It returns an empty source and line 0 if the 
+// thread has not started yet or the debug library is not available.
+func currentline(ls *luajit.State, threadid string) (string, int) {
+    top := ls.Gettop()
+    defer ls.Settop(top)
+    
+    ls.Getglobal("debug")
+    if !ls.Istable(-1) {
+        return "", 0
+    }
+    
+    pushthreadstable(ls)
+    ls.Getfield(-1, threadid)
+    if !ls.Isthread(-1) {
+        return "", 0
+    }
+    
+    // The first levels may be go functions, which have no current line
+    for level := 0; level < 4; level++ {
+        ls.Getfield(top + 1, "getinfo")
+        ls.Pushvalue(top + 3)
+        ls.Pushnumber(float64(level))
+        ls.Pushstring("Sl")
+        if ls.Pcall(3, 1, 0) != nil || !ls.Istable(-1) {
+            return "", 0
+        }
+        
+        ls.Getfield(-1, "currentline")
+        line := ls.Tointeger(-1)
+        ls.Getfield(-2, "short_src")
+        source := ls.Tostring(-1)
+        ls.Pop(3)
+        
+        if line > 0 {
+            return source, line
+        }
+    }
+    
+    return "", 0
+}
+
+// list is the lua function behind leap.threads(). It returns an array of tables with the
+// id, name, status, started (in seconds since the unix epoch), source and line of each 
+// running thread.
+func (this *ThreadRegistry) list(ls *luajit.State) int {
+    infos := this.List(ls)
+    
+    rows := make([]threadrow, len(infos))
+    for i, info := range infos {
+        rows[i] = threadrow{
+            Id: info.Id,
+            Name: info.Name,
+            Status: info.Status,
+            Started: float64(info.Started.UnixNano()) / float64(time.Second),
+            Source: info.Source,
+            Line: info.Line,
+        }
+    }
+    if pusherr := ls.Push(rows); pusherr != nil {
+        panic(pusherr)
+    }
+    
+    return 1
+}
+
+// pushthreadstable pushes the THREADS_REGISTRY_KEY table onto the stack, creating it if 
+// needed
+func pushthreadstable(ls *luajit.State) {
+    ls.Getfield(luajit.LUA_REGISTRYINDEX, THREADS_REGISTRY_KEY)
+    if ls.Istable(-1) {
+        return
+    }
+    
+    ls.Pop(1)
+    ls.Newtable()
+    ls.Pushvalue(-1)
+    ls.Setfield(luajit.LUA_REGISTRYINDEX, THREADS_REGISTRY_KEY)
+}
+
+type threadinfos []ThreadInfo
+
+func (this threadinfos) Len() int           { return len(this) }
+func (this threadinfos) Less(i, j int) bool { return this[i].Started.Before(this[j].Started) }
+func (this threadinfos) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -2,76 +2,61 @@ package nsleap
 
 import(
     "sync"
-    "log"
     "_leap/goluajit"
 )
 
+// WaitGroup is a sync.WaitGroup shared by lua threads, pushed as a userdata with the 
+// add, done and wait methods, called as wg:add(), wg:done() and wg:wait()
 type WaitGroup struct{
-    Gvindex int
     wg *sync.WaitGroup
-    mu *sync.Mutex
 }
 
 func NewWaitGroup(ls *luajit.State) int {
-    luajit.GlobalMutex.Lock()
-    defer luajit.GlobalMutex.Unlock()
-
-    wg := &WaitGroup{wg: &sync.WaitGroup{}, mu: &sync.Mutex{}}
-    
-    // Obtain a gvindex 
-    wg.Gvindex = luajit.Gvregistry.AddValue(wg)
-    
-    // Create new table. This will be returned
-    ls.Newtable()
-    
-    // Push add
-    ls.Pushfunction(wg.add)
-    ls.Setfield(-2, "add")
-    
-    // Push done
-    ls.Pushfunction(wg.done)
-    ls.Setfield(-2, "done")
-    
-    // Push wait
-    ls.Pushfunction(wg.wait)
-    ls.Setfield(-2, "wait")
-    
-    // Create metatable for table
-    ls.Pushmetatable(&luajit.Gometatable{
-        GCFunction: wg.gc,
-    })
+    wg := &WaitGroup{wg: &sync.WaitGroup{}}
     
-    // Set metatable for userdata
-    ls.Setmetatable(-2,)
+    // Push the waitgroup userdata. This will be returned
+    if pusherr := ls.PushObject(wg); pusherr != nil {
+        panic(pusherr)
+    }
     
     return 1
 }
 
-func (this *WaitGroup) add(ls *luajit.State) int {
-    luajit.GlobalMutex.Lock()
-    defer luajit.GlobalMutex.Unlock()
-    
-    this.wg.Add(1)
-    
-    return 0
+// Add adds delta, or 1 when it is missing, to the counter
+func (this *WaitGroup) Add(delta *int) {
+    if delta == nil {
+        this.wg.Add(1)
+    } else {
+        this.wg.Add(*delta)
+    }
 }
 
-func (this *WaitGroup) done(ls *luajit.State) int {
-    luajit.GlobalMutex.Lock()
-    defer luajit.GlobalMutex.Unlock()
-    
+// Done decrements the counter
+func (this *WaitGroup) Done() {
     this.wg.Done()
-    
-    return 0
 }
 
-func (this *WaitGroup) wait(ls *luajit.State) int {    
-    this.wg.Wait()
-    
-    return 0
-}
-
-func (this *WaitGroup) gc(ls *luajit.State) int {
-    log.Println("WAITGROUP GC")
-    return 0
+// Wait waits for the counter to reach zero without holding the Gil, and is interrupted
+// along with the calling code. The goroutine waiting on the counter then runs on until 
+// it reaches zero.
+func (this *WaitGroup) Wait(ls *luajit.State) {
+    ctx := ls.Context()
+    done := make(chan bool)
+    go func() {
+        this.wg.Wait()
+        close(done)
+    }()
+    
+    interrupted := false
+    ls.Unlocked(func() {
+        select {
+            case <- done:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Wait for waitgroup interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
 }
\ No newline at end of file
@@ -0,0 +1,341 @@
+package nsleap
+
+import(
+    "context"
+    "fmt"
+    "os"
+    "sync"
+    
+    "_leap/goluajit"
+)
+
+// WorkerQueueSize is the number of messages that may be posted to or from a worker 
+// before post blocks.
+const WorkerQueueSize = 64
+
+// WORKER_TYPENAME is the name of the metatable of Worker userdata
+const WORKER_TYPENAME = "leap.Worker"
+
+// Worker runs a lua chunk in its own lua state on its own goroutine. Unlike a Thread, 
+// a Worker shares nothing with the state that created it and therefore runs in parallel 
+// with it. The two sides only communicate by posting deep copied messages.
+//
+// Inside the worker, the global function post(value) posts a message to the parent and 
+// recv() returns the next message posted by the parent. If the chunk defines a global 
+// function onmessage, it is called with every message posted by the parent once the 
+// chunk has returned, until the parent closes the worker.
+//
+// The worker runs under the context of the code that created it, so it is interrupted
+// along with it. A worker gets the sandbox, memory limit and instruction limit of its
+// parent, and the source of a worker created by sandboxed code is always lua code, never
+// the path of a file.
+type Worker struct {
+    ctx context.Context
+    inbox chan interface{}
+    outbox chan interface{}
+    closing chan bool
+    done chan bool
+    err error
+    closeonce *sync.Once
+}
+
+// workermetatable is the metatable shared by all Worker userdata
+var workermetatable *luajit.Gometatable = &luajit.Gometatable{
+    Name: WORKER_TYPENAME,
+    Metatable: WORKER_TYPENAME,
+    GCFunction: workermethod((*Worker).gc),
+    Methods: map[string]luajit.Gofunction{
+        "post": workermethod((*Worker).post),
+        "recv": workermethod((*Worker).recv),
+        "close": workermethod((*Worker).close),
+        "wait": workermethod((*Worker).wait),
+    },
+}
+
+// workermethod adapts a Worker method to a Gofunction called on the Worker userdata
+func workermethod(method func(*Worker, *luajit.State) int) luajit.Gofunction {
+    return func(ls *luajit.State) int {
+        return method(ls.CheckGouserdata(1, WORKER_TYPENAME).(*Worker), ls)
+    }
+}
+
+func NewWorker(ls *luajit.State) int {
+    if ls.Gettop() < 1 || !ls.Isstring(1) {
+        ls.Pushstring("You must supply a path or lua source to leap.Worker() constructor")
+        ls.Error()
+    }
+    source := string(ls.Tolstring(1))
+    
+    worker := &Worker{
+        inbox: make(chan interface{}, WorkerQueueSize),
+        outbox: make(chan interface{}, WorkerQueueSize),
+        closing: make(chan bool),
+        done: make(chan bool),
+        closeonce: &sync.Once{},
+        ctx: ls.Context(),
+    }
+    // Create the worker state, with the sandbox and limits of its parent. Its Gil is 
+    // handed over to the worker goroutine
+    state, stateerr := luajit.NewstateWithOptions(ls.Options())
+    if stateerr != nil {
+        ls.Pushstring(stateerr.Error())
+        ls.Error()
+    }
+    state.Openlibs()
+    state.Pushmodule("leap", NewModule().Loader)
+    
+    state.Pushfunction(worker.workerpost)
+    state.Setglobal("post")
+    
+    state.Pushfunction(worker.workerrecv)
+    state.Setglobal("recv")
+    
+    // Load the worker chunk from a file if one exists at source, else treat source as lua 
+    // code. Sandboxed code may not name files, as it cannot load them itself, and loads
+    // bytecode only if its sandbox allows it
+    var loaderr error
+    if ls.Sandbox() != nil {
+        loaderr = state.Loadsource(source)
+    } else if _, staterr := os.Stat(source); staterr == nil {
+        loaderr = state.Loadfile(source)
+    } else {
+        loaderr = state.Loadstring(source)
+    }
+    if loaderr != nil {
+        state.Close()
+        ls.Pushstring(loaderr.Error())
+        ls.Error()
+    }
+    
+    go worker.run(state)
+    
+    // Create new userdata. This will be returned
+    ls.Pushmetatable(workermetatable)
+    ls.Pop(1)
+    ls.NewGouserdata(worker, WORKER_TYPENAME)
+    
+    return 1
+}
+
+// run calls the worker chunk and then dispatches messages to onmessage until the inbox 
+// is closed.
+func (this *Worker) run(state *luajit.State) {
+    defer close(this.done)
+    defer close(this.outbox)
+    defer state.Close()
+    
+    if pcallerr := state.PcallContext(this.ctx, 0, 0); pcallerr != nil {
+        this.err = pcallerr
+        return
+    }
+    
+    for {
+        state.Getglobal("onmessage")
+        if !state.Isfunction(-1) {
+            state.Pop(1)
+            return
+        }
+        
+        var msg interface{}
+        var ok bool
+        var nexterr error
+        state.Unlocked(func() {
+            msg, ok, nexterr = this.next(this.ctx)
+        })
+        if nexterr != nil {
+            state.Pop(1)
+            this.err = fmt.Errorf("Worker interrupted: %w", nexterr)
+            return
+        }
+        if !ok {
+            state.Pop(1)
+            return
+        }
+        
+        pushmessage(state, msg)
+        if pcallerr := state.PcallContext(this.ctx, 1, 0); pcallerr != nil {
+            this.err = pcallerr
+            return
+        }
+    }
+}
+
+// post deep copies its argument and posts it to the worker. Posting to a worker that
+// has finished raises its error, and a post blocked on a full inbox is interrupted 
+// along with the calling code.
+func (this *Worker) post(ls *luajit.State) int {
+    msg, copyerr := copymessage(ls, 2); if copyerr != nil {
+        ls.Pushstring(copyerr.Error())
+        ls.Error()
+    }
+    
+    ctx := ls.Context()
+    failure := ""
+    ls.Unlocked(func() {
+        select {
+            case <- this.closing:
+                failure = "Attempt to post to a closed worker"
+                return
+            case <- this.done:
+                failure = this.finished()
+                return
+            default:
+        }
+        select {
+            case this.inbox <- msg:
+            case <- this.closing:
+                failure = "Attempt to post to a closed worker"
+            case <- this.done:
+                failure = this.finished()
+            case <- ctx.Done():
+                failure = "Post to worker interrupted: " + ctx.Err().Error()
+        }
+    })
+    if failure != "" {
+        ls.Pushstring(failure)
+        ls.Error()
+    }
+    
+    return 0
+}
+
+// finished returns the error message for posting to a worker that has finished
+func (this *Worker) finished() string {
+    if this.err != nil {
+        return "Attempt to post to a failed worker: " + this.err.Error()
+    }
+    return "Attempt to post to a finished worker"
+}
+
+// recv blocks until the worker posts a message and returns it with true, or returns 
+// nil and false once the worker has finished and all its messages have been received.
+func (this *Worker) recv(ls *luajit.State) int {
+    ctx := ls.Context()
+    var msg interface{}
+    var ok, interrupted bool
+    ls.Unlocked(func() {
+        select {
+            case msg, ok = <- this.outbox:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Receive from worker interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    
+    pushmessage(ls, msg)
+    ls.Pushboolean(ok)
+    
+    return 2
+}
+
+// close closes the worker, ending its onmessage loop once pending messages are dispatched. 
+// Posting to a closed worker is an error.
+func (this *Worker) close(ls *luajit.State) int {
+    this.closeonce.Do(func() {
+        close(this.closing)
+    })
+    
+    return 0
+}
+
+// wait blocks until the worker has finished. It returns true, or false and the error 
+// message if the worker failed.
+func (this *Worker) wait(ls *luajit.State) int {
+    ctx := ls.Context()
+    interrupted := false
+    ls.Unlocked(func() {
+        select {
+            case <- this.done:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Wait for worker interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    
+    if this.err != nil {
+        ls.Pushboolean(false)
+        ls.Pushstring(this.err.Error())
+        return 2
+    }
+    
+    ls.Pushboolean(true)
+    return 1
+}
+
+// workerpost deep copies its argument and posts it to the parent
+func (this *Worker) workerpost(ls *luajit.State) int {
+    msg, copyerr := copymessage(ls, 1); if copyerr != nil {
+        ls.Pushstring(copyerr.Error())
+        ls.Error()
+    }
+    
+    ctx := ls.Context()
+    interrupted := false
+    ls.Unlocked(func() {
+        select {
+            case this.outbox <- msg:
+            case <- ctx.Done():
+                interrupted = true
+        }
+    })
+    if interrupted {
+        ls.Pushstring("Post to parent interrupted: " + ctx.Err().Error())
+        ls.Error()
+    }
+    
+    return 0
+}
+
+// workerrecv blocks until the parent posts a message and returns it with true, or 
+// returns nil and false once the parent has closed the worker.
+func (this *Worker) workerrecv(ls *luajit.State) int {
+    ctx := ls.Context()
+    var msg interface{}
+    var ok bool
+    var nexterr error
+    ls.Unlocked(func() {
+        msg, ok, nexterr = this.next(ctx)
+    })
+    if nexterr != nil {
+        ls.Pushstring("Receive from parent interrupted: " + nexterr.Error())
+        ls.Error()
+    }
+    
+    pushmessage(ls, msg)
+    ls.Pushboolean(ok)
+    
+    return 2
+}
+
+// next blocks until a message is posted to the worker and returns it with true. Once the
+// worker is closed, it returns the messages still pending and then nil and false. It 
+// returns the error of ctx if ctx is done first.
+func (this *Worker) next(ctx context.Context) (interface{}, bool, error) {
+    select {
+        case msg := <- this.inbox:
+            return msg, true, nil
+        case <- this.closing:
+            select {
+                case msg := <- this.inbox:
+                    return msg, true, nil
+                default:
+                    return nil, false, nil
+            }
+        case <- ctx.Done():
+            return nil, false, ctx.Err()
+    }
+}
+
+// gc closes the worker once its parent can no longer post to it
+func (this *Worker) gc(ls *luajit.State) int {
+    this.closeonce.Do(func() {
+        close(this.closing)
+    })
+    return 0
+}
\ No newline at end of file
@@ -28,10 +28,40 @@ func (this *Module) Loader(luastate *luajit.State) int {
     luastate.Pushfunction(NewWaitGroup)
     luastate.Setfield(-2, "WaitGroup")
     
+    // Push nsleap.Channel
+    luastate.Pushfunction(NewChannel)
+    luastate.Setfield(-2, "Channel")
+    
+    // Push nsleap.After
+    luastate.Pushfunction(After)
+    luastate.Setfield(-2, "after")
+    
+    // Push nsleap.Select
+    luastate.Pushfunction(Select)
+    luastate.Setfield(-2, "select")
+    
     // Push nsleap.Thread
     luastate.Pushfunction(NewThread)
     luastate.Setfield(-2, "Thread")
     
+    // Push nsleap.Threads
+    luastate.Pushfunction(Threads.list)
+    luastate.Setfield(-2, "threads")
+    
+    // Push nsleap.Worker
+    luastate.Pushfunction(NewWorker)
+    luastate.Setfield(-2, "Worker")
+    
+    // Push nsleap.Jit
+    luastate.Newtable()
+    luastate.Pushfunction(JitOn)
+    luastate.Setfield(-2, "on")
+    luastate.Pushfunction(JitOff)
+    luastate.Setfield(-2, "off")
+    luastate.Pushfunction(JitFlush)
+    luastate.Setfield(-2, "flush")
+    luastate.Setfield(-2, "jit")
+    
     // push module mt to stack
     luastate.Pushmetatable(&luajit.Gometatable{
         IndexFunction: this.index,
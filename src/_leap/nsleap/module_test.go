@@ -0,0 +1,396 @@
+package nsleap
+
+import(
+    "bytes"
+    "context"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    
+    "_leap/goluajit"
+)
+
+// newstate returns a state with the leap module loaded as the global leap, as the leap
+// command sets it up, restricted by sandbox if it is not nil
+func newstate(t *testing.T, sandbox *luajit.Sandbox) *luajit.State {
+    return newstatewithoptions(t, luajit.Options{Sandbox: sandbox})
+}
+
+// newstatewithoptions returns a state set up like newstate, created with options
+func newstatewithoptions(t *testing.T, options luajit.Options) *luajit.State {
+    s, err := luajit.NewstateWithOptions(options)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Openlibs()
+    s.Pushmodule("leap", NewModule().Loader)
+    
+    if err := s.Loadstring(`leap = require("leap")`); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Pcall(0, 0, 0); err != nil {
+        t.Fatal(err)
+    }
+    return s
+}
+
+// run runs script under ctx and returns its result as a string, or its error
+func run(s *luajit.State, ctx context.Context, script string) (string, error) {
+    if err := s.Loadstring(script); err != nil {
+        return "", err
+    }
+    if err := s.PcallContext(ctx, 0, 1); err != nil {
+        return "", err
+    }
+    defer s.Pop(1)
+    
+    return s.Tostring(-1), nil
+}
+
+// runscripts runs each script of cases and checks that its result holds the expected
+// string. The scripts have 10 seconds to complete, so a script blocking without
+// watching the context of its call hangs the test instead.
+func runscripts(t *testing.T, s *luajit.State, cases [][2]string) {
+    for _, c := range cases {
+        ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+        result, err := run(s, ctx, c[0])
+        cancel()
+        if err != nil {
+            t.Errorf("unexpected error from %s: %v", c[0], err)
+            continue
+        }
+        if !strings.Contains(result, c[1]) {
+            t.Errorf("expected %q from %s, got %q", c[1], c[0], result)
+        }
+    }
+}
+
+// runinterrupted runs script with a timeout of 100 milliseconds and checks that it
+// fails with an error holding the expected string
+func runinterrupted(t *testing.T, s *luajit.State, script string, expected string) {
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+    
+    done := make(chan error, 1)
+    go func() {
+        _, err := run(s, ctx, script)
+        done <- err
+    }()
+    
+    select {
+        case err := <- done:
+            if err == nil || !strings.Contains(err.Error(), expected) {
+                t.Errorf("expected an error holding %q from %s, got %v", expected, script, err)
+            }
+        case <- time.After(10 * time.Second):
+            t.Fatalf("expected %s to be interrupted, still running after 10 seconds", script)
+    }
+}
+
+func TestWorker(t *testing.T) {
+    s := newstate(t, nil)
+    defer s.Close()
+    
+    runscripts(t, s, [][2]string{
+        {`local w = leap.Worker("function onmessage(m) post(m.n * 2) end")
+          w:post({n = 21})
+          local v = w:recv()
+          w:close()
+          return v .. " " .. tostring(w:wait())`, "42 true"},
+        {`local w = leap.Worker("post(recv() + 1)")
+          w:post(1)
+          local v, ok = w:recv()
+          local last, lastok = w:recv()
+          return v .. " " .. tostring(ok) .. " " .. tostring(last) .. " " .. tostring(lastok)`, "2 true nil false"},
+        {`local w = leap.Worker("error('boom')")
+          local ok, err = w:wait()
+          return tostring(ok) .. " " .. err`, "false RUNTIME ERROR: [string \"error('boom')\"]:1: boom"},
+        {`local w = leap.Worker("error('boom')")
+          local ok, err = pcall(function() for i = 1, 100 do w:post(i) end end)
+          return err`, "Attempt to post to a failed worker: RUNTIME ERROR: [string \"error('boom')\"]:1: boom"},
+        {`local w = leap.Worker("x = 1")
+          w:wait()
+          local ok, err = pcall(w.post, w, 1)
+          return err`, "Attempt to post to a finished worker"},
+        {`local w = leap.Worker("function onmessage(m) end")
+          w:close()
+          local ok, err = pcall(w.post, w, 1)
+          return err`, "Attempt to post to a closed worker"},
+        {`local ok, err = pcall(leap.Worker, "x = ")
+          return err`, "unexpected symbol"},
+        {`local w = leap.Worker("function onmessage(m) post(m) end")
+          w:post({["k\0ey"] = "a\0b"})
+          local v = w:recv()
+          w:close()
+          return #v["k\0ey"] .. " " .. v["k\0ey"]:byte(3)`, "3 98"},
+        {`local w = leap.Worker("function onmessage(m) end")
+          local ok, err = pcall(w.post, w, function() end)
+          w:close()
+          return err`, "function"},
+    })
+    
+    // a full inbox no longer blocks the poster once its call is interrupted
+    runinterrupted(t, s, `local w = leap.Worker("while true do end")
+        for i = 1, 1000 do w:post(i) end`, "deadline exceeded")
+    runinterrupted(t, s, `local w = leap.Worker("while true do end")
+        w:recv()`, "deadline exceeded")
+    
+    // workers waiting for messages stop once the code that created them is done
+    ctx, cancel := context.WithCancel(context.Background())
+    if _, err := run(s, ctx, `recvworker = leap.Worker("recv()")
+        messageworker = leap.Worker("function onmessage(m) end")`); err != nil {
+        t.Fatal(err)
+    }
+    cancel()
+    runscripts(t, s, [][2]string{
+        {`local ok, err = recvworker:wait()
+          return tostring(ok) .. " " .. err`, "Receive from parent interrupted: context canceled"},
+        {`local ok, err = messageworker:wait()
+          return tostring(ok) .. " " .. err`, "false Worker interrupted: context canceled"},
+    })
+}
+
+func TestChannel(t *testing.T) {
+    s := newstate(t, nil)
+    defer s.Close()
+    
+    runscripts(t, s, [][2]string{
+        {`local c = leap.Channel(2)
+          c:send({a = 1})
+          local sent = c:trysend(2)
+          local full = c:trysend(3)
+          local n = c:len()
+          local v = c:recv()
+          return v.a .. " " .. tostring(sent) .. " " .. tostring(full) .. " " .. n`, "1 true false 2"},
+        {`local c = leap.Channel(1)
+          c:send("a\0b")
+          local v = c:recv()
+          return #v .. " " .. tostring(v == "a\0b")`, "3 true"},
+        {`local c = leap.Channel(1)
+          local t = {1}
+          c:send(t)
+          t[1] = 2
+          return c:recv()[1]`, "1"},
+        {`local c = leap.Channel(1)
+          c:send(1)
+          c:close()
+          local v, ok = c:recv()
+          local last, lastok = c:recv()
+          return v .. " " .. tostring(ok) .. " " .. tostring(last) .. " " .. tostring(lastok)`, "1 true nil false"},
+        {`local c = leap.Channel()
+          c:close()
+          local ok, err = pcall(c.send, c, 1)
+          return err`, "Attempt to send on a closed channel"},
+        {`local c = leap.Channel()
+          c:close()
+          local ok, err = pcall(c.close, c)
+          return err`, "Attempt to close a closed channel"},
+        {`local c = leap.Channel()
+          return tostring(c:trysend(1)) .. " " .. tostring(c:tryrecv())`, "false nil"},
+        {`local ok, err = pcall(leap.Channel, -1)
+          return err`, "capacity must be a non-negative number"},
+        {`local c = leap.Channel()
+          local ok, err = pcall(function() local v = c.recv({}); return v end)
+          return err`, "leap.Channel expected, got table"},
+    })
+    
+    // blocked sends and receives are interrupted along with their caller
+    runinterrupted(t, s, `leap.Channel():recv()`, "Receive from channel interrupted: context deadline exceeded")
+    runinterrupted(t, s, `leap.Channel():send(1)`, "Send on channel interrupted: context deadline exceeded")
+}
+
+func TestSelect(t *testing.T) {
+    s := newstate(t, nil)
+    defer s.Close()
+    
+    runscripts(t, s, [][2]string{
+        {`local a, b = leap.Channel(1), leap.Channel(1)
+          b:send("b")
+          local i, v, ok = leap.select{{a}, {b, "recv"}}
+          return i .. " " .. v .. " " .. tostring(ok)`, "2 b true"},
+        {`local a = leap.Channel(1)
+          a:send("a\0b")
+          local i, v = leap.select{{a}}
+          return tostring(v == "a\0b")`, "true"},
+        {`local a = leap.Channel(1)
+          local i = leap.select{{a, "send", "x"}}
+          return i .. " " .. a:recv()`, "1 x"},
+        {`local a = leap.Channel()
+          local i, v = leap.select{{a}, default = function() return "nothing ready" end}
+          return i .. " " .. v`, "default nothing ready"},
+        {`local a = leap.Channel()
+          local i = leap.select{{a}, {leap.after(0.01)}}
+          return i`, "2"},
+        {`local a = leap.Channel()
+          a:close()
+          local i, v, ok = leap.select{{a}}
+          return i .. " " .. tostring(v) .. " " .. tostring(ok)`, "1 nil false"},
+        {`local a = leap.Channel()
+          a:close()
+          local ok, err = pcall(leap.select, {{a, "send", 1}})
+          return err`, "Attempt to send on a closed channel in leap.select()"},
+        {`local h = leap.Thread(function() return 1 end):run()
+          local i, v, ok = leap.select{{h}}
+          return i .. " " .. tostring(ok)`, "1 false"},
+        {`local ok, err = pcall(leap.select, 1)
+          return err`, "You must supply a table of cases to leap.select()"},
+        {`local a = leap.Channel()
+          local ok, err = pcall(leap.select, {{a}, default = function() error("no case ready") end})
+          return tostring(ok) .. " " .. err:match("no case ready")`, "false no case ready"},
+    })
+    
+    // a blocked select is interrupted along with its caller
+    runinterrupted(t, s, `leap.select{{leap.Channel()}, {leap.after(60)}}`, "leap.select() interrupted: context deadline exceeded")
+}
+
+func TestThread(t *testing.T) {
+    s := newstate(t, nil)
+    defer s.Close()
+    
+    runscripts(t, s, [][2]string{
+        {`local h = leap.Thread(function(a, b) return a + b, "done" end):run(1, 2)
+          local sum, word = h:join()
+          local again = h:join()
+          return sum .. " " .. word .. " " .. again .. " " .. h:status()`, "3 done 3 done"},
+        {`local h = leap.Thread(function() error("boom") end):run()
+          local ok, err = pcall(h.join, h)
+          return h:status() .. " " .. err`, "failed"},
+        {`local h = leap.Thread(function() error("boom") end):run()
+          local ok, err = pcall(h.join, h)
+          return err`, "boom"},
+        {`local c = leap.Channel()
+          local h = leap.Thread(function() c:recv() end, "waiter"):run()
+          local running = leap.threads()
+          c:send(1)
+          h:join()
+          return running[1].name .. " " .. running[1].status .. " " .. (running[1].id == h.id and "same" or "other") .. " " .. #leap.threads()`, "waiter running same 0"},
+        {`local ok, err = pcall(leap.Thread, 1)
+          return err`, "leap.Thread() expects a function, got number"},
+    })
+    
+    // threads run under the context of the code that started them
+    runinterrupted(t, s, `leap.Thread(function() while true do end end):run():join()`, "deadline exceeded")
+    
+    // a join is interrupted along with its caller, even when the thread is not
+    if _, err := run(s, context.Background(), `c = leap.Channel(); h = leap.Thread(function() return c:recv() end):run()`); err != nil {
+        t.Fatal(err)
+    }
+    runinterrupted(t, s, `h:join()`, "Join of thread interrupted: context deadline exceeded")
+    runscripts(t, s, [][2]string{
+        {`c:send("late"); return h:join()`, "late"},
+    })
+}
+
+func TestMutexAndWaitGroup(t *testing.T) {
+    s := newstate(t, nil)
+    defer s.Close()
+    
+    runscripts(t, s, [][2]string{
+        {`local mu, wg = leap.Mutex(), leap.WaitGroup()
+          local n = 0
+          for i = 1, 50 do
+              wg:add(1)
+              leap.Thread(function()
+                  mu:lock(); n = n + 1; mu:unlock()
+                  wg:done()
+              end):run()
+          end
+          wg:wait()
+          return n`, "50"},
+        {`local mu = leap.Mutex()
+          local ok, err = pcall(function() mu:unlock() end)
+          return err`, "unlock of unlocked mutex"},
+        {`local mu = leap.Mutex()
+          local ok, err = pcall(function() mu.lock() end)
+          return err`, "call methods with ':'"},
+        {`return getmetatable(leap.Mutex())`, "*nsleap.Mutex"},
+        {`local ok = pcall(function() getmetatable(leap.WaitGroup()).__methods.wait = nil end)
+          return tostring(ok)`, "false"},
+    })
+    
+    // blocked locks and waits are interrupted along with their caller
+    runinterrupted(t, s, `local mu = leap.Mutex(); mu:lock(); mu:lock()`, "Lock of mutex interrupted: context deadline exceeded")
+    runinterrupted(t, s, `local wg = leap.WaitGroup(); wg:add(1); wg:wait()`, "Wait for waitgroup interrupted: context deadline exceeded")
+}
+
+func TestWorkerSandbox(t *testing.T) {
+    dir := t.TempDir()
+    source := filepath.Join(dir, "worker.lua")
+    if err := os.WriteFile(source, []byte(`post("escaped")`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    // precompile the same chunk to a bytecode file
+    compiler := luajit.Newstate()
+    defer compiler.Close()
+    if err := compiler.Loadstring(`post("escaped")`); err != nil {
+        t.Fatal(err)
+    }
+    bytecode := &bytes.Buffer{}
+    if err := compiler.Dump(bytecode); err != nil {
+        t.Fatal(err)
+    }
+    binary := filepath.Join(dir, "worker.luac")
+    if err := os.WriteFile(binary, bytecode.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    s := newstate(t, nil)
+    defer s.Close()
+    s.Pushstring(source)
+    s.Setglobal("source")
+    runscripts(t, s, [][2]string{
+        {`return leap.Worker(source):recv()`, "escaped"},
+    })
+    
+    sandbox := &luajit.Sandbox{
+        Libs: []string{"base", "package", "table", "string", "math", "bit"},
+        Modules: []string{"leap"},
+        Deny: []string{"dofile", "loadfile", "getfenv", "setfenv"},
+    }
+    sandboxed := newstate(t, sandbox)
+    defer sandboxed.Close()
+    sandboxed.Pushstring(source)
+    sandboxed.Setglobal("source")
+    sandboxed.Pushstring(binary)
+    sandboxed.Setglobal("binary")
+    
+    // sandboxed code can neither load files through a worker nor bytecode
+    runscripts(t, sandboxed, [][2]string{
+        {`local ok, err = pcall(leap.Worker, source); return tostring(ok) .. " " .. err`, "false SYNTAX ERROR: [string \"/"},
+        {`local ok, err = pcall(leap.Worker, binary); return tostring(ok) .. " " .. err`, "false SYNTAX ERROR: [string \"/"},
+        {`local ok, err = pcall(leap.Worker, string.dump(function() post("escaped") end)); return err`, "attempt to load a binary chunk"},
+        {`return tostring(leap.Worker("post(loadfile == nil and io == nil)"):recv())`, "true"},
+    })
+    
+    sandbox.Bytecode = true
+    bytecodeallowed := newstate(t, sandbox)
+    defer bytecodeallowed.Close()
+    runscripts(t, bytecodeallowed, [][2]string{
+        {`return leap.Worker(string.dump(function() post("compiled") end)):recv()`, "compiled"},
+    })
+}
+
+func TestWorkerLimits(t *testing.T) {
+    // the strict profile of the leap command, with limits
+    s := newstatewithoptions(t, luajit.Options{
+        MemoryLimit: 4 << 20,
+        InstructionLimit: 1000000,
+        Sandbox: &luajit.Sandbox{
+            Libs: []string{"base", "package", "table", "string", "math", "bit"},
+            Modules: []string{"leap"},
+            Deny: []string{"dofile", "loadfile", "getfenv", "setfenv"},
+        },
+    })
+    defer s.Close()
+    
+    // workers cannot get around the limits of their parent
+    runscripts(t, s, [][2]string{
+        {`local ok, err = leap.Worker("while true do end"):wait()
+          return tostring(ok) .. " " .. err:match("instruction limit exceeded")`, "false instruction limit exceeded"},
+        {`local ok, err = leap.Worker("local t = {}; for i = 1, 1e7 do t[i] = tostring(i) end"):wait()
+          return tostring(ok) .. " " .. err:match("not enough memory")`, "false not enough memory"},
+    })
+}
\ No newline at end of file
@@ -1,14 +1,14 @@
-local mu = leap.Mutex()
-local wg = leap.WaitGroup()
+local handles = {}
 local ct = 0
 
 for a=1, 100 do
-    wg:add(1)
-    leap.Thread(function()
-        wg:done()
-    end):run()
+    handles[a] = leap.Thread(function(n)
+        return n
+    end):run(a)
 end
 
-wg:wait()
+for a=1, 100 do
+    ct = ct + handles[a]:join()
+end
 
-print(ct)
\ No newline at end of file
+print(ct)